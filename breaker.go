@@ -0,0 +1,60 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "sort"
+    "time"
+    "github.com/robwil/peer-aware-groupcache/ring"
+)
+
+// breakers holds the circuit breaker of every ring, keyed by ring name.
+var breakers = make(map[string]*ring.Breaker)
+
+// probers holds the prober of every ring, keyed by ring name, when probing is enabled.
+var probers = make(map[string]*ring.Prober)
+
+// probeInterval returns how often peers are probed, from PEER_PROBE_INTERVAL (e.g. "5s"), or 0 not to probe them.
+func probeInterval() time.Duration {
+    interval := os.Getenv("PEER_PROBE_INTERVAL")
+    if interval == "" {
+        return 0
+    }
+    d, err := time.ParseDuration(interval)
+    if err != nil {
+        log.Fatalf("error parsing PEER_PROBE_INTERVAL: %v", err)
+    }
+    return d
+}
+
+// withBreaker has the groups of the named ring stop sending keys to peers which keep failing, even though
+// Kubernetes still considers them ready, and also route around peers which this pod cannot reach when probing is
+// enabled. It must be called before the ring's other pickers are set, as they wrap it.
+func withBreaker(rings *ring.Rings, ringName string) {
+    pool := rings.Pool(ringName)
+    breaker := ring.NewBreaker(pool, breakerOptions())
+    breakers[ringName] = breaker
+    rings.SetPicker(ringName, breaker)
+    if interval := probeInterval(); interval > 0 {
+        probers[ringName] = ring.NewProber(pool, &ring.ProbeOptions{Interval: interval}, breaker.SetReachable)
+    }
+}
+
+func writeBreakerStats(w io.Writer) {
+    names := make([]string, 0, len(breakers))
+    for name := range breakers {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        breaker := breakers[name]
+        fmt.Fprintf(w, "Open circuits of %s: %v (opened %v, closed %v, rerouted %v keys)\n", name, breaker.Open(),
+            breaker.Stats.Opened.String(), breaker.Stats.Closed.String(), breaker.Stats.Rerouted.String())
+        if prober := probers[name]; prober != nil {
+            fmt.Fprintf(w, "Unreachable peers of %s: %v (%v of %v probes failed)\n", name, prober.Unreachable(),
+                prober.Stats.ProbeFailures.String(), prober.Stats.Probes.String())
+        }
+    }
+}
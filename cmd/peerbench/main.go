@@ -0,0 +1,149 @@
+// Command peerbench compares the HTTP and gRPC peer transports of the ring package on a local multi-node setup.
+//
+// It starts a number of nodes on localhost, each serving the peer protocol both over HTTP (ring.Handler) and over
+// gRPC (ring.RegisterGRPCServer), and then loads keys from them through a ring.Pool using each transport in turn,
+// reporting throughput and latency percentiles. The nodes share this process and its groups, so every key is only
+// computed once and the numbers reflect the cost of the transport alone.
+//
+//     go run ./cmd/peerbench -nodes 3 -requests 50000 -concurrency 32 -size 1024
+package main
+
+import (
+    "flag"
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "sort"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+    "github.com/robwil/peer-aware-groupcache/groupcache"
+    "github.com/robwil/peer-aware-groupcache/ring"
+    pb "github.com/golang/groupcache/groupcachepb"
+    "google.golang.org/grpc"
+)
+
+const groupName = "peerbench"
+
+var (
+    nodes       = flag.Int("nodes", 3, "number of local nodes")
+    requests    = flag.Int("requests", 20000, "number of requests per transport")
+    concurrency = flag.Int("concurrency", 32, "number of concurrent requests")
+    keys        = flag.Int("keys", 1000, "number of distinct keys")
+    size        = flag.Int("size", 1024, "size of each value in bytes")
+)
+
+// node is a local peer, serving the peer protocol over both transports.
+type node struct {
+    httpURL  string
+    grpcAddr string
+}
+
+func startNode() node {
+    httpListener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        log.Fatalf("error listening: %v", err)
+    }
+    go http.Serve(httpListener, &ring.Handler{})
+
+    grpcListener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        log.Fatalf("error listening: %v", err)
+    }
+    server := grpc.NewServer()
+    ring.RegisterGRPCServer(server)
+    go server.Serve(grpcListener)
+
+    return node{httpURL: "http://" + httpListener.Addr().String(), grpcAddr: grpcListener.Addr().String()}
+}
+
+// result is the outcome of benchmarking one transport.
+type result struct {
+    elapsed   time.Duration
+    errors    int64
+    latencies []time.Duration
+}
+
+func (r result) percentile(p float64) time.Duration {
+    if len(r.latencies) == 0 {
+        return 0
+    }
+    return r.latencies[int(p*float64(len(r.latencies)-1))]
+}
+
+// run loads keys from the peers of pool, which never picks the benchmark itself as it is not one of the peers.
+func run(pool *ring.Pool) result {
+    var next int64
+    var errors int64
+    latencies := make([]time.Duration, *requests)
+    group := groupName
+    start := time.Now()
+    var wg sync.WaitGroup
+    for w := 0; w < *concurrency; w++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for {
+                i := atomic.AddInt64(&next, 1) - 1
+                if i >= int64(*requests) {
+                    return
+                }
+                key := strconv.Itoa(int(i) % *keys)
+                peer, ok := pool.PickPeer(key)
+                if !ok {
+                    log.Fatalf("no peer for key %s", key)
+                }
+                began := time.Now()
+                if err := peer.Get(nil, &pb.GetRequest{Group: &group, Key: &key}, &pb.GetResponse{}); err != nil {
+                    atomic.AddInt64(&errors, 1)
+                }
+                latencies[i] = time.Since(began)
+            }
+        }()
+    }
+    wg.Wait()
+    r := result{elapsed: time.Since(start), errors: errors, latencies: latencies}
+    sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+    return r
+}
+
+func main() {
+    flag.Parse()
+    value := make([]byte, *size)
+    groupcache.NewGroup(groupName, 64<<20, groupcache.GetterFunc(func(_ groupcache.Context, _ string, dest groupcache.Sink) error {
+        return dest.SetBytes(value)
+    }))
+
+    var httpPeers []string
+    grpcAddrs := make(map[string]string)
+    for i := 0; i < *nodes; i++ {
+        n := startNode()
+        httpPeers = append(httpPeers, n.httpURL)
+        grpcAddrs[n.httpURL] = n.grpcAddr
+    }
+
+    // the benchmark is not a peer itself, so that every request goes over the network
+    httpPool := ring.NewPool("bench", nil)
+    httpPool.Set(httpPeers...)
+    grpcPool := ring.NewPool("bench", &ring.Options{Getters: &ring.GRPCGetters{
+        Address: func(peer string) string { return grpcAddrs[peer] },
+    }})
+    grpcPool.Set(httpPeers...)
+
+    // warm up the nodes' caches and connections, so that only the transports are measured
+    run(httpPool)
+    run(grpcPool)
+
+    fmt.Printf("%d nodes, %d requests, %d concurrent, %d keys of %d bytes\n", *nodes, *requests, *concurrency, *keys, *size)
+    fmt.Printf("%-10s %12s %10s %10s %10s %8s\n", "transport", "requests/s", "p50", "p90", "p99", "errors")
+    for _, transport := range []struct {
+        name string
+        pool *ring.Pool
+    }{{"http", httpPool}, {"grpc", grpcPool}} {
+        r := run(transport.pool)
+        fmt.Printf("%-10s %12.0f %10v %10v %10v %8d\n", transport.name, float64(*requests)/r.elapsed.Seconds(),
+            r.percentile(0.5), r.percentile(0.9), r.percentile(0.99), r.errors)
+    }
+}
@@ -0,0 +1,108 @@
+// Command ringcompare compares the ring strategies of the ring package: how evenly they spread keys over peers, and
+// how many keys move to another peer when one peer joins or leaves.
+//
+// Bounded loads balances by the load of peers rather than by key alone, so for it every key is counted as one unit
+// of load which is never released, as if every key was being requested at once.
+//
+//     go run ./cmd/ringcompare -peers 10 -keys 100000
+package main
+
+import (
+    "flag"
+    "fmt"
+    "math"
+    "strconv"
+    "github.com/robwil/peer-aware-groupcache/ring"
+)
+
+var (
+    peers    = flag.Int("peers", 10, "number of peers")
+    keys     = flag.Int("keys", 100000, "number of keys")
+    replicas = flag.Int("replicas", 50, "virtual nodes per peer, for the consistent strategies")
+    factor   = flag.Float64("factor", 1.25, "load factor of bounded loads")
+)
+
+func peerURL(i int) string {
+    return fmt.Sprintf("http://10.0.%d.%d:5000", i/256, i%256)
+}
+
+// owners assigns every key to a peer with a fresh instance of a strategy.
+func owners(newStrategy func() ring.Strategy, peers []string) []string {
+    strategy := newStrategy()
+    hash := strategy.Hash(peers)
+    bounded, _ := strategy.(*ring.BoundedLoads)
+    owners := make([]string, *keys)
+    for i := range owners {
+        owners[i] = hash.Get(strconv.Itoa(i))
+        if bounded != nil {
+            bounded.Acquire(owners[i])
+        }
+    }
+    return owners
+}
+
+// spread returns the largest and smallest share of keys of any peer, relative to the mean, and the standard
+// deviation of the shares, relative to the mean.
+func spread(owners []string, peers []string) (max float64, min float64, stddev float64) {
+    counts := make(map[string]int, len(peers))
+    for _, owner := range owners {
+        counts[owner]++
+    }
+    mean := float64(len(owners)) / float64(len(peers))
+    min = math.Inf(1)
+    var variance float64
+    for _, peer := range peers {
+        share := float64(counts[peer]) / mean
+        max = math.Max(max, share)
+        min = math.Min(min, share)
+        variance += (share - 1) * (share - 1)
+    }
+    return max, min, math.Sqrt(variance / float64(len(peers)))
+}
+
+// moved returns the fraction of keys with a different owner.
+func moved(before []string, after []string) float64 {
+    n := 0
+    for i := range before {
+        if before[i] != after[i] {
+            n++
+        }
+    }
+    return float64(n) / float64(len(before))
+}
+
+func main() {
+    flag.Parse()
+    var current []string
+    for i := 0; i < *peers; i++ {
+        current = append(current, peerURL(i))
+    }
+    joined := append(append([]string(nil), current...), peerURL(*peers))
+    var left []string
+    for i, peer := range current {
+        if i != *peers/2 {
+            left = append(left, peer)
+        }
+    }
+
+    strategies := []struct {
+        name string
+        new  func() ring.Strategy
+    }{
+        {"consistent", func() ring.Strategy { return ring.Consistent{Replicas: *replicas} }},
+        {"rendezvous", func() ring.Strategy { return ring.Rendezvous{} }},
+        {"jump", func() ring.Strategy { return ring.Jump{} }},
+        {"bounded", func() ring.Strategy { return &ring.BoundedLoads{Replicas: *replicas, Factor: *factor} }},
+    }
+
+    fmt.Printf("%d peers, %d keys\n", *peers, *keys)
+    fmt.Printf("%-12s %8s %8s %8s %10s %10s\n", "strategy", "max", "min", "stddev", "join", "leave")
+    fmt.Printf("%-12s %8s %8s %8s %9.1f%% %9.1f%%\n", "(ideal)", "1.00", "1.00", "0.00",
+        100/float64(*peers+1), 100/float64(*peers))
+    for _, s := range strategies {
+        before := owners(s.new, current)
+        max, min, stddev := spread(before, current)
+        fmt.Printf("%-12s %8.2f %8.2f %8.2f %9.1f%% %9.1f%%\n", s.name, max, min, stddev,
+            100*moved(before, owners(s.new, joined)), 100*moved(before, owners(s.new, left)))
+    }
+}
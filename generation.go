@@ -0,0 +1,98 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "sort"
+    "github.com/robwil/peer-aware-groupcache/groupcache"
+    "github.com/robwil/peer-aware-groupcache/peerwatch"
+    "github.com/robwil/peer-aware-groupcache/ring"
+)
+
+// generations is only set when the generations of groups are stored in the ConfigMap named by
+// generationConfigMap, for their values to be retired all at once by bumping them.
+var generations *ring.Generations
+var generationConfigMap string
+
+// groupGetter returns the getter of every group, which sees keys without their generation.
+func groupGetter() groupcache.Getter {
+    if generations == nil {
+        return primeFactorsGetter
+    }
+    return ring.GenerationGetter(primeFactorsGetter)
+}
+
+// groupKey returns the key to get n with from group, mixed with the group's generation if there is one.
+func groupKey(group *groupcache.Group, n string) string {
+    if generations == nil {
+        return n
+    }
+    return generations.Key(group.Name(), n)
+}
+
+// allGroups returns every group, whichever way rings are set up.
+func allGroups() []*groupcache.Group {
+    if shards != nil {
+        groups := make([]*groupcache.Group, 0, len(shards.groups))
+        for _, group := range shards.groups {
+            groups = append(groups, group)
+        }
+        return groups
+    }
+    groups := []*groupcache.Group{PrimeFactorsGroup}
+    if PrimeFactorsHeavyGroup != nil {
+        groups = append(groups, PrimeFactorsHeavyGroup)
+    }
+    return groups
+}
+
+// watchGenerations keeps the generations of groups in agreement with every other pod.
+func watchGenerations() {
+    if err := peerwatch.WatchGenerations(generationConfigMap, generations.Set); err != nil {
+        // groups stay at their current generation until the ConfigMap can be read
+        log.Printf("WARNING: error reading group generations: %v", err)
+    }
+}
+
+// Generation bumps the generation of the group named by the group parameter, or of every group without one, for
+// every value they cached to be computed again. It only accepts POST requests.
+func Generation(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    if generations == nil {
+        http.Error(w, "group generations are not enabled", http.StatusNotFound)
+        return
+    }
+    groups := allGroups()
+    if name := r.FormValue("group"); name != "" {
+        group := groupcache.GetGroup(name)
+        if group == nil {
+            http.Error(w, "no such group: "+name, http.StatusNotFound)
+            return
+        }
+        groups = []*groupcache.Group{group}
+    }
+    for _, group := range groups {
+        epoch, generation, err := peerwatch.BumpGeneration(generationConfigMap, group.Name())
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        // other pods follow as soon as they see the ConfigMap change
+        generations.Set(epoch, map[string]int64{group.Name(): generation})
+        fmt.Fprintf(w, "%s: generation %d\n", group.Name(), generation)
+    }
+}
+
+func writeGenerationStats(w io.Writer) {
+    groups := allGroups()
+    sort.Slice(groups, func(i, j int) bool { return groups[i].Name() < groups[j].Name() })
+    fmt.Fprintf(w, "Generation epoch: %q\n", generations.Epoch())
+    for _, group := range groups {
+        fmt.Fprintf(w, "Generation of %s: %d\n", group.Name(), generations.Generation(group.Name()))
+    }
+}
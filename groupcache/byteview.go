@@ -21,6 +21,7 @@ import (
 	"errors"
 	"io"
 	"strings"
+	"time"
 )
 
 // A ByteView holds an immutable view of bytes.
@@ -33,6 +34,13 @@ type ByteView struct {
 	// If b is non-nil, b is used, else s is used.
 	b []byte
 	s string
+	e time.Time // when the value expires, zero if never
+}
+
+// Expire returns when the value expires, or the zero time if it never
+// does (see Group.SetTTL).
+func (v ByteView) Expire() time.Time {
+	return v.e
 }
 
 // Len returns the view's length.
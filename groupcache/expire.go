@@ -0,0 +1,142 @@
+// expire.go defines when cached values expire.
+
+package groupcache
+
+import (
+	"time"
+
+	pb "github.com/golang/groupcache/groupcachepb"
+	"github.com/golang/protobuf/proto"
+)
+
+// SetTTL has the values the group loads expire ttl after they are
+// loaded, unless their Getter sets otherwise with SetValueTTL. Expired
+// values are dropped from both the main and the hot cache, and loaded
+// again on their next Get. A ttl of 0, the default, means values never
+// expire. It must be called before the group is used.
+func (g *Group) SetTTL(ttl time.Duration) {
+	g.ttl = ttl
+}
+
+// TTL returns the time to live of the group's values, see SetTTL.
+func (g *Group) TTL() time.Duration {
+	return g.ttl
+}
+
+// SetClock sets the function the group reads the current time from to
+// expire values, e.g. a fake clock in tests. Defaults to time.Now. It
+// must be called before the group is used.
+func (g *Group) SetClock(now func() time.Time) {
+	g.clock = now
+}
+
+func (g *Group) now() time.Time {
+	if g.clock == nil {
+		return time.Now()
+	}
+	return g.clock()
+}
+
+// expireAfter returns when a value loaded at now expires after ttl, or
+// the zero time if ttl is not positive.
+func expireAfter(now time.Time, ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
+
+// expired returns whether v has expired at now.
+func expired(v ByteView, now time.Time) bool {
+	return !v.e.IsZero() && !now.Before(v.e)
+}
+
+// SetValueTTL sets how long after it is loaded the value a Getter
+// populates dest with expires, overriding the group's TTL: a ttl of 0
+// means the value never expires. It is meant for Getters which know
+// how long their values stay valid, and has no effect on Sinks other
+// than the ones a Group passes to its Getter.
+func SetValueTTL(dest Sink, ttl time.Duration) {
+	if s, ok := dest.(*ttlSink); ok {
+		s.ttl = ttl
+		s.set = true
+	}
+}
+
+// ttlSink is the Sink a Group passes to its Getter, recording the TTL
+// set with SetValueTTL, if any.
+type ttlSink struct {
+	Sink
+	ttl time.Duration
+	set bool
+}
+
+// expire returns when the value loaded into s at now expires, with the
+// group's ttl unless the Getter set its own.
+func (s *ttlSink) expire(now time.Time, ttl time.Duration) time.Time {
+	if s.set {
+		ttl = s.ttl
+	}
+	return expireAfter(now, ttl)
+}
+
+// expireTag is the key of field 3 of GetResponse, a varint holding when
+// the value expires in nanoseconds since the Unix epoch, as in other
+// forks of groupcache. The generated groupcachepb package does not know
+// the field, so it is kept in XXX_unrecognized, which peers running
+// upstream groupcache ignore.
+const expireTag = 3<<3 | proto.WireVarint
+
+// NewGetResponse returns the response to a peer's request for value,
+// which tells the peer when the value expires, if it does.
+func NewGetResponse(value ByteView) *pb.GetResponse {
+	res := &pb.GetResponse{Value: value.ByteSlice()}
+	if !value.e.IsZero() {
+		res.XXX_unrecognized = append(proto.EncodeVarint(expireTag), proto.EncodeVarint(uint64(value.e.UnixNano()))...)
+	}
+	return res
+}
+
+// responseExpire returns when the value of res expires, as set by
+// NewGetResponse, or the zero time if it never does.
+func responseExpire(res *pb.GetResponse) time.Time {
+	var expire time.Time
+	buf := proto.NewBuffer(res.XXX_unrecognized)
+	for {
+		tag, err := buf.DecodeVarint()
+		if err != nil {
+			return expire
+		}
+		var v uint64
+		switch tag & 7 {
+		case proto.WireVarint:
+			v, err = buf.DecodeVarint()
+		case proto.WireFixed64:
+			v, err = buf.DecodeFixed64()
+		case proto.WireFixed32:
+			v, err = buf.DecodeFixed32()
+		case proto.WireBytes:
+			_, err = buf.DecodeRawBytes(false)
+		default:
+			return expire
+		}
+		if err != nil {
+			return expire
+		}
+		if tag == expireTag && int64(v) > 0 {
+			expire = time.Unix(0, int64(v))
+		}
+	}
+}
+
+// peerExpire returns when the value of res, fetched from a peer at now,
+// expires: when the peer says, but no later than the group's TTL, so
+// that values from peers which do not say (e.g. running upstream
+// groupcache) expire too.
+func (g *Group) peerExpire(res *pb.GetResponse, now time.Time) time.Time {
+	expire := responseExpire(res)
+	if local := expireAfter(now, g.ttl); !local.IsZero() && (expire.IsZero() || local.Before(expire)) {
+		return local
+	}
+	return expire
+}
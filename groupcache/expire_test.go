@@ -0,0 +1,207 @@
+package groupcache
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	pb "github.com/golang/groupcache/groupcachepb"
+	"github.com/golang/protobuf/proto"
+)
+
+// fakeClock is a clock for groups which only moves when told to.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Unix(1000000, 0)}
+}
+
+// noPeers owns every key locally.
+type noPeers struct{}
+
+func (noPeers) PickPeer(string) (ProtoGetter, bool) { return nil, false }
+
+// groupPeer serves requests from the group of another process, in
+// memory, encoding responses the way peers do.
+type groupPeer struct {
+	g *Group
+}
+
+func (p groupPeer) Get(ctx Context, in *pb.GetRequest, out *pb.GetResponse) error {
+	var v ByteView
+	if err := p.g.Get(ctx, in.GetKey(), ByteViewSink(&v)); err != nil {
+		return err
+	}
+	b, err := proto.Marshal(NewGetResponse(v))
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(b, out)
+}
+
+// keepHotPicker picks peer for every key, and keeps every value in the
+// hot cache.
+type keepHotPicker struct {
+	peer ProtoGetter
+}
+
+func (p keepHotPicker) PickPeer(string) (ProtoGetter, bool) { return p.peer, true }
+
+func (keepHotPicker) KeepHot(string) bool { return true }
+
+// countingGetter counts its loads, setting the TTL of values keyed in
+// ttls.
+func countingGetter(loads *int, ttls map[string]time.Duration) Getter {
+	return GetterFunc(func(_ Context, key string, dest Sink) error {
+		*loads++
+		if ttl, ok := ttls[key]; ok {
+			SetValueTTL(dest, ttl)
+		}
+		return dest.SetString("value of " + key)
+	})
+}
+
+func TestMainCacheExpiry(t *testing.T) {
+	clock := newFakeClock()
+	loads := 0
+	g := newGroup("expire-main", 1<<20, countingGetter(&loads, nil), noPeers{})
+	g.SetClock(clock.now)
+	g.SetTTL(time.Minute)
+
+	var s string
+	for i := 0; i < 2; i++ {
+		if err := g.Get(nil, "k", StringSink(&s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if loads != 1 {
+		t.Fatalf("loads = %d before expiry, want 1", loads)
+	}
+	var v ByteView
+	g.Get(nil, "k", ByteViewSink(&v))
+	if want := clock.t.Add(time.Minute); !v.Expire().Equal(want) {
+		t.Errorf("Expire() = %v, want %v", v.Expire(), want)
+	}
+
+	clock.advance(time.Minute - time.Nanosecond)
+	if _, ok := g.Peek("k"); !ok {
+		t.Error("Peek missed before expiry")
+	}
+	clock.advance(time.Nanosecond)
+	if _, ok := g.Peek("k"); ok {
+		t.Error("Peek hit an expired value")
+	}
+	if n := len(g.MainCacheEntries()); n != 0 {
+		t.Errorf("MainCacheEntries has %d expired entries", n)
+	}
+	g.Get(nil, "k", StringSink(&s))
+	if loads != 2 {
+		t.Errorf("loads = %d after expiry, want 2", loads)
+	}
+	if expired := g.CacheStats(MainCache).Expired; expired != 1 {
+		t.Errorf("Expired = %d, want 1", expired)
+	}
+}
+
+func TestValueTTLOverridesGroupTTL(t *testing.T) {
+	clock := newFakeClock()
+	loads := 0
+	ttls := map[string]time.Duration{"short": time.Second, "forever": 0}
+	g := newGroup("expire-value", 1<<20, countingGetter(&loads, ttls), noPeers{})
+	g.SetClock(clock.now)
+	g.SetTTL(time.Minute)
+
+	var short, forever ByteView
+	g.Get(nil, "short", ByteViewSink(&short))
+	g.Get(nil, "forever", ByteViewSink(&forever))
+	if want := clock.t.Add(time.Second); !short.Expire().Equal(want) {
+		t.Errorf("short expires at %v, want %v", short.Expire(), want)
+	}
+	if !forever.Expire().IsZero() {
+		t.Errorf("forever expires at %v, want never", forever.Expire())
+	}
+
+	clock.advance(time.Hour)
+	var s string
+	g.Get(nil, "short", StringSink(&s))
+	g.Get(nil, "forever", StringSink(&s))
+	if loads != 3 {
+		t.Errorf("loads = %d, want 3 (short loaded again, forever cached)", loads)
+	}
+}
+
+func TestHotCacheExpiry(t *testing.T) {
+	clock := newFakeClock()
+	ownerLoads := 0
+	owner := newGroup("expire-hot-owner", 1<<20, countingGetter(&ownerLoads, map[string]time.Duration{"k": time.Second}), noPeers{})
+	owner.SetClock(clock.now)
+
+	g := newGroup("expire-hot", 1<<20, GetterFunc(func(Context, string, Sink) error {
+		t.Fatal("loaded locally instead of from its owner")
+		return nil
+	}), keepHotPicker{groupPeer{owner}})
+	g.SetClock(clock.now)
+	g.SetTTL(time.Hour)
+
+	var v ByteView
+	g.Get(nil, "k", ByteViewSink(&v))
+	if want := clock.t.Add(time.Second); !v.Expire().Equal(want) {
+		t.Errorf("value from owner expires at %v, want %v", v.Expire(), want)
+	}
+	g.Get(nil, "k", ByteViewSink(&v))
+	if hits := g.CacheStats(HotCache).Hits; hits != 1 {
+		t.Fatalf("hot cache hits = %d, want 1", hits)
+	}
+
+	clock.advance(time.Second)
+	g.Get(nil, "k", ByteViewSink(&v))
+	if expired := g.CacheStats(HotCache).Expired; expired != 1 {
+		t.Errorf("hot cache Expired = %d, want 1", expired)
+	}
+	if ownerLoads != 2 {
+		t.Errorf("owner loads = %d, want 2", ownerLoads)
+	}
+}
+
+func TestGetResponseExpire(t *testing.T) {
+	expire := time.Unix(1234, 5678)
+	res := NewGetResponse(ByteView{s: "v", e: expire})
+	want := append(proto.EncodeVarint(3<<3|proto.WireVarint), proto.EncodeVarint(uint64(expire.UnixNano()))...)
+	if !bytes.Equal(res.XXX_unrecognized, want) {
+		t.Errorf("XXX_unrecognized = %x, want field 3 %x", res.XXX_unrecognized, want)
+	}
+
+	b, err := proto.Marshal(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &pb.GetResponse{}
+	if err := proto.Unmarshal(b, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if string(decoded.Value) != "v" {
+		t.Errorf("Value = %q, want %q", decoded.Value, "v")
+	}
+
+	g := newGroup("expire-response", 1<<20, GetterFunc(func(Context, string, Sink) error { return nil }), noPeers{})
+	now := time.Unix(1000, 0)
+	if got := g.peerExpire(decoded, now); !got.Equal(expire) {
+		t.Errorf("peerExpire = %v, want %v", got, expire)
+	}
+	g.SetTTL(time.Second)
+	if got, want := g.peerExpire(decoded, now), now.Add(time.Second); !got.Equal(want) {
+		t.Errorf("peerExpire with a shorter group TTL = %v, want %v", got, want)
+	}
+	if got, want := g.peerExpire(NewGetResponse(ByteView{s: "v"}), now), now.Add(time.Second); !got.Equal(want) {
+		t.Errorf("peerExpire of a value which never expires = %v, want the group TTL %v", got, want)
+	}
+	if got := responseExpire(NewGetResponse(ByteView{s: "v"})); !got.IsZero() {
+		t.Errorf("responseExpire of a value which never expires = %v", got)
+	}
+}
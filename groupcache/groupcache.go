@@ -22,17 +22,30 @@ limitations under the License.
 // or finally gets the data.  In the common case, many concurrent
 // cache misses across a set of peers for the same key result in just
 // one cache fill.
+//
+// This is a fork of github.com/golang/groupcache, maintained as part of
+// peer-aware-groupcache. It adds access to the cached entries and their
+// hit counts (so they can be handed off between peers when the ring
+// changes or a peer shuts down), lets a key's new owner fetch it
+// from its previous owner's cache during ring transitions, doesn't
+// start loading keys whose caller's context.Context is done, makes what
+// happens when a peer fails configurable (see PeerFallback), and lets
+// the PeerPicker decide which values from peers to mirror in the hot
+// cache (see HotCachePicker), lets values expire (see Group.SetTTL),
+// and lets bad values be removed (see Group.Remove).
 package groupcache
 
 import (
+	"context"
 	"errors"
 	"math/rand"
 	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	pb "github.com/golang/groupcache/groupcachepb"
-	"github.com/golang/groupcache/lru"
+	"github.com/robwil/peer-aware-groupcache/groupcache/lru"
 	"github.com/golang/groupcache/singleflight"
 )
 
@@ -43,7 +56,8 @@ type Getter interface {
 	// The returned data must be unversioned. That is, key must
 	// uniquely describe the loaded data, without an implicit
 	// current time, and without relying on cache expiration
-	// mechanisms.
+	// mechanisms. Values which do change may instead expire, see
+	// Group.SetTTL and SetValueTTL.
 	Get(ctx Context, key string, dest Sink) error
 }
 
@@ -144,6 +158,9 @@ type Group struct {
 	peersOnce  sync.Once
 	peers      PeerPicker
 	cacheBytes int64 // limit for sum of mainCache and hotCache size
+	fallback   PeerFallback
+	ttl        time.Duration    // see SetTTL
+	clock      func() time.Time // see SetClock
 
 	// mainCache is a cache of the keys for which this process
 	// (amongst its peers) is authoritative. That is, this cache
@@ -172,6 +189,27 @@ type Group struct {
 	Stats Stats
 }
 
+// PeerFallback is what a Group does when loading a key from the peer
+// owning it fails.
+type PeerFallback int
+
+const (
+	// FallbackPopulate loads the key locally and stores it in the
+	// main cache, as if this process owned it. This is the default.
+	FallbackPopulate PeerFallback = iota
+	// FallbackNoPopulate loads the key locally without caching it,
+	// leaving the main cache to the keys this process owns.
+	FallbackNoPopulate
+	// FallbackNone returns the peer's error.
+	FallbackNone
+)
+
+// SetPeerFallback sets what the group does when loading a key from
+// its peer fails. It must be called before the group is used.
+func (g *Group) SetPeerFallback(fallback PeerFallback) {
+	g.fallback = fallback
+}
+
 // flightGroup is defined as an interface which flightgroup.Group
 // satisfies.  We define this so that we may test with an alternate
 // implementation.
@@ -191,6 +229,11 @@ type Stats struct {
 	LocalLoads     AtomicInt // total good local loads
 	LocalLoadErrs  AtomicInt // total bad local loads
 	ServerRequests AtomicInt // gets that came over the network from peers
+
+	PreviousPeerLoads AtomicInt // loads served from the cache of the key's previous owner
+	PeerFallbacks     AtomicInt // good local loads after the owning peer failed
+	HotKeeps          AtomicInt // values from peers kept in the hot cache at the PeerPicker's request
+	Removes           AtomicInt // calls to Remove
 }
 
 // Name returns the name of the group.
@@ -235,6 +278,13 @@ func (g *Group) Get(ctx Context, key string, dest Sink) error {
 // load loads key either by invoking the getter locally or by sending it to another machine.
 func (g *Group) load(ctx Context, key string, dest Sink) (value ByteView, destPopulated bool, err error) {
 	g.Stats.Loads.Add(1)
+	if err := canceled(ctx); err != nil {
+		// the caller gave up already, don't load the key on its
+		// behalf
+		return ByteView{}, false, err
+	}
+	caller := ctx
+	ctx = sharedContext(ctx)
 	viewi, err := g.loadGroup.Do(key, func() (interface{}, error) {
 		// Check the cache again because singleflight can only dedup calls
 		// that overlap concurrently.  It's possible for 2 concurrent
@@ -264,6 +314,7 @@ func (g *Group) load(ctx Context, key string, dest Sink) (value ByteView, destPo
 		g.Stats.LoadsDeduped.Add(1)
 		var value ByteView
 		var err error
+		peerFailed := false
 		if peer, ok := g.peers.PickPeer(key); ok {
 			value, err = g.getFromPeer(ctx, peer, key)
 			if err == nil {
@@ -275,6 +326,14 @@ func (g *Group) load(ctx Context, key string, dest Sink) (value ByteView, destPo
 			// log of the past few for /groupcachez?  It's
 			// probably boring (normal task movement), so not
 			// worth logging I imagine.
+			if g.fallback == FallbackNone {
+				return nil, err
+			}
+			peerFailed = true
+		} else if value, ok := g.getFromPreviousPeer(ctx, key); ok {
+			g.Stats.PreviousPeerLoads.Add(1)
+			g.populateCache(key, value, &g.mainCache)
+			return value, nil
 		}
 		value, err = g.getLocally(ctx, key, dest)
 		if err != nil {
@@ -283,21 +342,45 @@ func (g *Group) load(ctx Context, key string, dest Sink) (value ByteView, destPo
 		}
 		g.Stats.LocalLoads.Add(1)
 		destPopulated = true // only one caller of load gets this return value
+		if peerFailed {
+			g.Stats.PeerFallbacks.Add(1)
+			if g.fallback == FallbackNoPopulate {
+				return value, nil
+			}
+		}
 		g.populateCache(key, value, &g.mainCache)
 		return value, nil
 	})
-	if err == nil {
-		value = viewi.(ByteView)
+	if err != nil {
+		if cerr := canceled(caller); cerr != nil {
+			// report why this caller got no value, rather
+			// than the error of the shared load
+			err = cerr
+		}
+		return
 	}
+	value = viewi.(ByteView)
 	return
 }
 
 func (g *Group) getLocally(ctx Context, key string, dest Sink) (ByteView, error) {
-	err := g.getter.Get(ctx, key, dest)
+	now := g.now()
+	sink := &ttlSink{Sink: dest}
+	err := g.getter.Get(ctx, key, sink)
+	if err != nil {
+		return ByteView{}, err
+	}
+	value, err := dest.view()
 	if err != nil {
 		return ByteView{}, err
 	}
-	return dest.view()
+	value.e = sink.expire(now, g.ttl)
+	if s, ok := dest.(*byteViewSink); ok {
+		// dest is populated already, let its caller know when
+		// the value expires too
+		s.dst.e = value.e
+	}
+	return value, nil
 }
 
 func (g *Group) getFromPeer(ctx Context, peer ProtoGetter, key string) (ByteView, error) {
@@ -306,29 +389,90 @@ func (g *Group) getFromPeer(ctx Context, peer ProtoGetter, key string) (ByteView
 		Key:   &key,
 	}
 	res := &pb.GetResponse{}
+	now := g.now()
 	err := peer.Get(ctx, req, res)
 	if err != nil {
 		return ByteView{}, err
 	}
-	value := ByteView{b: res.Value}
+	value := ByteView{b: res.Value, e: g.peerExpire(res, now)}
 	// TODO(bradfitz): use res.MinuteQps or something smart to
 	// conditionally populate hotCache.  For now just do it some
-	// percentage of the time.
-	if rand.Intn(10) == 0 {
+	// percentage of the time, unless the PeerPicker knows better.
+	if hot, ok := g.peers.(HotCachePicker); ok && hot.KeepHot(key) {
+		g.Stats.HotKeeps.Add(1)
+		g.populateCache(key, value, &g.hotCache)
+	} else if rand.Intn(10) == 0 {
 		g.populateCache(key, value, &g.hotCache)
 	}
 	return value, nil
 }
 
+// canceled returns the error of ctx if it is a context.Context which
+// is done, and nil otherwise.
+func canceled(ctx Context) error {
+	if c, ok := ctx.(context.Context); ok && c != nil {
+		return c.Err()
+	}
+	return nil
+}
+
+// sharedContext returns the context a load started by a caller with ctx
+// runs with. A load is shared by every caller getting the key at the
+// time, so it keeps the values of ctx but not its deadline or
+// cancelation: the caller which happened to start it giving up must not
+// fail it for the others.
+func sharedContext(ctx Context) Context {
+	if c, ok := ctx.(context.Context); ok && c != nil {
+		return detachedContext{c}
+	}
+	return ctx
+}
+
+// detachedContext is a context.Context with the values of another one,
+// which is never done.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+
+func (detachedContext) Done() <-chan struct{} { return nil }
+
+func (detachedContext) Err() error { return nil }
+
+// getFromPreviousPeer tries the cache of the peer which owned key
+// before the peers last changed, if the PeerPicker keeps track of it.
+func (g *Group) getFromPreviousPeer(ctx Context, key string) (ByteView, bool) {
+	previous, ok := g.peers.(PreviousPeerPicker)
+	if !ok {
+		return ByteView{}, false
+	}
+	peer, ok := previous.PickPreviousPeer(key)
+	if !ok {
+		return ByteView{}, false
+	}
+	req := &pb.GetRequest{
+		Group: &g.name,
+		Key:   &key,
+	}
+	res := &pb.GetResponse{}
+	now := g.now()
+	if err := peer.Get(ctx, req, res); err != nil {
+		return ByteView{}, false
+	}
+	return ByteView{b: res.Value, e: g.peerExpire(res, now)}, true
+}
+
 func (g *Group) lookupCache(key string) (value ByteView, ok bool) {
 	if g.cacheBytes <= 0 {
 		return
 	}
-	value, ok = g.mainCache.get(key)
+	now := g.now()
+	value, ok = g.mainCache.get(key, now)
 	if ok {
 		return
 	}
-	value, ok = g.hotCache.get(key)
+	value, ok = g.hotCache.get(key, now)
 	return
 }
 
@@ -357,6 +501,55 @@ func (g *Group) populateCache(key string, value ByteView, cache *cache) {
 	}
 }
 
+// MainCacheKeys returns the keys held in the main cache, most
+// recently used first.
+func (g *Group) MainCacheKeys() []string {
+	return g.mainCache.keys()
+}
+
+// CacheEntry is a snapshot of a cache entry.
+type CacheEntry struct {
+	Key   string
+	Value ByteView
+	Hits  int64 // cache hits since the entry was added
+}
+
+// MainCacheEntries returns a snapshot of the entries held in the main
+// cache which have not expired, most recently used first.
+func (g *Group) MainCacheEntries() []CacheEntry {
+	return g.mainCache.entries(g.now())
+}
+
+// Peek returns the value of key from the main cache, without loading
+// it on a miss and without marking it as recently used. Expired values
+// are misses.
+func (g *Group) Peek(key string) (ByteView, bool) {
+	return g.mainCache.peek(key, g.now())
+}
+
+// Populate stores value in the main cache as if it had just been
+// loaded locally, e.g. when a peer hands off a key now owned by this
+// process. The value expires at expire, never if it is the zero time,
+// and is dropped if it has expired already.
+func (g *Group) Populate(key string, value []byte, expire time.Time) {
+	v := ByteView{b: cloneBytes(value), e: expire}
+	if expired(v, g.now()) {
+		return
+	}
+	g.populateCache(key, v, &g.mainCache)
+}
+
+// Remove removes key from the main and hot caches of this process, so
+// that its next Get loads it again. Other processes keep their copies:
+// removing a key from every peer is up to the PeerPicker's transport
+// (e.g. ring.Pool.Remove). A load of the key already under way may
+// still cache the value it loads.
+func (g *Group) Remove(key string) {
+	g.Stats.Removes.Add(1)
+	g.mainCache.remove(key)
+	g.hotCache.remove(key)
+}
+
 // CacheType represents a type of cache.
 type CacheType int
 
@@ -392,6 +585,7 @@ type cache struct {
 	lru        *lru.Cache
 	nhit, nget int64
 	nevict     int64 // number of evictions
+	nexpire    int64 // number of expired entries removed
 }
 
 func (c *cache) stats() CacheStats {
@@ -403,6 +597,7 @@ func (c *cache) stats() CacheStats {
 		Gets:      c.nget,
 		Hits:      c.nhit,
 		Evictions: c.nevict,
+		Expired:   c.nexpire,
 	}
 }
 
@@ -414,15 +609,20 @@ func (c *cache) add(key string, value ByteView) {
 			OnEvicted: func(key lru.Key, value interface{}) {
 				val := value.(ByteView)
 				c.nbytes -= int64(len(key.(string))) + int64(val.Len())
-				c.nevict++
 			},
 		}
 	}
+	if old, ok := c.lru.Peek(key); ok {
+		// lru.Add replaces the value without evicting the old one
+		c.nbytes -= int64(len(key)) + int64(old.(ByteView).Len())
+	}
 	c.lru.Add(key, value)
 	c.nbytes += int64(len(key)) + int64(value.Len())
 }
 
-func (c *cache) get(key string) (value ByteView, ok bool) {
+// get returns the value of key, removing it instead if it has expired
+// at now.
+func (c *cache) get(key string, now time.Time) (value ByteView, ok bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.nget++
@@ -433,15 +633,71 @@ func (c *cache) get(key string) (value ByteView, ok bool) {
 	if !ok {
 		return
 	}
+	if value = vi.(ByteView); expired(value, now) {
+		c.lru.Remove(key)
+		c.nexpire++
+		return ByteView{}, false
+	}
 	c.nhit++
+	return value, true
+}
+
+func (c *cache) peek(key string, now time.Time) (value ByteView, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.lru == nil {
+		return
+	}
+	vi, ok := c.lru.Peek(key)
+	if !ok || expired(vi.(ByteView), now) {
+		return ByteView{}, false
+	}
 	return vi.(ByteView), true
 }
 
-func (c *cache) removeOldest() {
+func (c *cache) remove(key string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if c.lru != nil {
+		c.lru.Remove(key)
+	}
+}
+
+func (c *cache) keys() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.lru == nil {
+		return nil
+	}
+	keys := make([]string, 0, c.lru.Len())
+	for _, key := range c.lru.Keys() {
+		keys = append(keys, key.(string))
+	}
+	return keys
+}
+
+func (c *cache) entries(now time.Time) []CacheEntry {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.lru == nil {
+		return nil
+	}
+	lruEntries := c.lru.Entries()
+	entries := make([]CacheEntry, 0, len(lruEntries))
+	for _, e := range lruEntries {
+		if value := e.Value.(ByteView); !expired(value, now) {
+			entries = append(entries, CacheEntry{Key: e.Key.(string), Value: value, Hits: e.Hits})
+		}
+	}
+	return entries
+}
+
+func (c *cache) removeOldest() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lru != nil && c.lru.Len() > 0 {
 		c.lru.RemoveOldest()
+		c.nevict++
 	}
 }
 
@@ -488,4 +744,5 @@ type CacheStats struct {
 	Gets      int64
 	Hits      int64
 	Evictions int64
+	Expired   int64 // entries removed once expired
 }
@@ -39,6 +39,14 @@ type Key interface{}
 type entry struct {
 	key   Key
 	value interface{}
+	hits  int64 // number of Gets since the entry was added
+}
+
+// Entry is a snapshot of a cache entry, returned by Entries.
+type Entry struct {
+	Key   Key
+	Value interface{}
+	Hits  int64
 }
 
 // New creates a new Cache.
@@ -63,7 +71,7 @@ func (c *Cache) Add(key Key, value interface{}) {
 		ee.Value.(*entry).value = value
 		return
 	}
-	ele := c.ll.PushFront(&entry{key, value})
+	ele := c.ll.PushFront(&entry{key: key, value: value})
 	c.cache[key] = ele
 	if c.MaxEntries != 0 && c.ll.Len() > c.MaxEntries {
 		c.RemoveOldest()
@@ -77,11 +85,50 @@ func (c *Cache) Get(key Key) (value interface{}, ok bool) {
 	}
 	if ele, hit := c.cache[key]; hit {
 		c.ll.MoveToFront(ele)
+		ele.Value.(*entry).hits++
+		return ele.Value.(*entry).value, true
+	}
+	return
+}
+
+// Peek looks up a key's value from the cache, without marking it as
+// recently used.
+func (c *Cache) Peek(key Key) (value interface{}, ok bool) {
+	if c.cache == nil {
+		return
+	}
+	if ele, hit := c.cache[key]; hit {
 		return ele.Value.(*entry).value, true
 	}
 	return
 }
 
+// Keys returns the keys in the cache, most recently used first.
+func (c *Cache) Keys() []Key {
+	if c.cache == nil {
+		return nil
+	}
+	keys := make([]Key, 0, c.ll.Len())
+	for ele := c.ll.Front(); ele != nil; ele = ele.Next() {
+		keys = append(keys, ele.Value.(*entry).key)
+	}
+	return keys
+}
+
+// Entries returns a snapshot of the entries in the cache, most recently
+// used first.
+func (c *Cache) Entries() []Entry {
+	if c.cache == nil {
+		return nil
+	}
+	entries := make([]Entry, 0, c.ll.Len())
+	for ele := c.ll.Front(); ele != nil; ele = ele.Next() {
+		kv := ele.Value.(*entry)
+		entries = append(entries, Entry{Key: kv.key, Value: kv.value, Hits: kv.hits})
+	}
+	return entries
+}
+
 // Remove removes the provided key from the cache.
 func (c *Cache) Remove(key Key) {
 	if c.cache == nil {
@@ -41,6 +41,29 @@ type PeerPicker interface {
 	PickPeer(key string) (peer ProtoGetter, ok bool)
 }
 
+// PreviousPeerPicker may optionally be implemented by a PeerPicker
+// which remembers who owned keys before its peers last changed.
+// Right after a change, a key's new owner has nothing cached while
+// the previous owner may still have it, so the group tries the
+// previous owner before loading the key locally.
+type PreviousPeerPicker interface {
+	// PickPreviousPeer returns the peer which owned the specific
+	// key before the latest change, and true, if there is one worth
+	// asking. The returned peer must only answer from its cache,
+	// failing rather than loading the key.
+	PickPreviousPeer(key string) (peer ProtoGetter, ok bool)
+}
+
+// HotCachePicker may optionally be implemented by a PeerPicker which
+// knows which keys fetched from peers are worth mirroring in the hot
+// cache, e.g. keys this process serves to other peers on behalf of
+// their owner. Other keys still go to the hot cache some of the time.
+type HotCachePicker interface {
+	// KeepHot reports whether key, just fetched from a peer, should
+	// be kept in the hot cache.
+	KeepHot(key string) bool
+}
+
 // NoPeers is an implementation of PeerPicker that never finds a peer.
 type NoPeers struct{}
 
@@ -0,0 +1,94 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "os"
+    "strconv"
+    "github.com/robwil/peer-aware-groupcache/groupcache"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "github.com/robwil/peer-aware-groupcache/peerwatch"
+    "github.com/robwil/peer-aware-groupcache/ring"
+)
+
+// HeavyThreshold is the smallest number whose factors are cached in PrimeFactorsHeavyGroup, when it exists.
+const HeavyThreshold = 1 << 40
+
+// PrimeFactorsHeavyGroup is only set when running with a separate group for heavy numbers.
+var PrimeFactorsHeavyGroup *groupcache.Group
+
+// groupRings is only set when running with a separate group for heavy numbers.
+var groupRings *ring.Rings
+
+func isHeavy(nStr string) bool {
+    n, err := strconv.ParseInt(nStr, 10, 64)
+    return err == nil && n >= HeavyThreshold
+}
+
+// heavyRingOptions returns the options of the heavy group's ring, whose strategy is HEAVY_RING_STRATEGY if set.
+func heavyRingOptions() *ring.Options {
+    // There are few heavy pods, so use more replicas to spread keys evenly between them
+    opts := ring.Options{Replicas: 200}
+    if strategy := os.Getenv("HEAVY_RING_STRATEGY"); strategy != "" {
+        opts.Strategy = ringStrategy(strategy, opts.Replicas)
+    }
+    return ringOptions(opts)
+}
+
+// heavyHotKeyOptions returns how the heavy group spreads its hot keys over replicas: as set by the HEAVY_HOT_KEY_
+// env vars, or else like the other groups.
+func heavyHotKeyOptions() *ring.HotKeyOptions {
+    if opts := hotKeyOptions("HEAVY_HOT_KEY"); opts != nil {
+        return opts
+    }
+    return hotKeyOptions("HOT_KEY")
+}
+
+func setupGroups(myIp string, listOptions metav1.ListOptions, heavyListOptions metav1.ListOptions) {
+    groupRings = ring.NewRings()
+    http.Handle(ring.DefaultBasePath, peerHandler())
+
+    var err error
+    PrimeFactorsGroup, err = groupRings.NewGroup(ring.GroupSpec{
+        Name:         "primeFactors",
+        CacheBytes:   1 << 20,
+        Getter:       groupGetter(),
+        Source:       peerwatch.PodSource{ListOptions: listOptions},
+        Options:      ringOptions(ring.Options{}),
+        PeerFallback: PeerFallback,
+        TTL:          groupTTL(),
+    }, myIp, getPodUrl)
+    if err != nil {
+        log.Printf("WARNING: error getting initial pods: %v", err)
+    }
+    withBreaker(groupRings, "primeFactors")
+    withHotKeys(groupRings, "primeFactors", hotKeyOptions("HOT_KEY"))
+    withZones(groupRings, "primeFactors")
+    rebalancers = append(rebalancers, ring.NewRebalancer(groupRings.Pool("primeFactors"), []*groupcache.Group{PrimeFactorsGroup}, nil))
+    PrimeFactorsHeavyGroup, err = groupRings.NewGroup(ring.GroupSpec{
+        Name:         "primeFactorsHeavy",
+        CacheBytes:   1 << 20,
+        Getter:       groupGetter(),
+        Source:       peerwatch.PodSource{ListOptions: heavyListOptions},
+        Options:      heavyRingOptions(),
+        PeerFallback: PeerFallback,
+        TTL:          groupTTL(),
+    }, myIp, getPodUrl)
+    if err != nil {
+        log.Printf("WARNING: error getting initial heavy pods: %v", err)
+    }
+    withBreaker(groupRings, "primeFactorsHeavy")
+    withHotKeys(groupRings, "primeFactorsHeavy", heavyHotKeyOptions())
+    withZones(groupRings, "primeFactorsHeavy")
+    rebalancers = append(rebalancers, ring.NewRebalancer(groupRings.Pool("primeFactorsHeavy"), []*groupcache.Group{PrimeFactorsHeavyGroup}, nil))
+}
+
+func writeGroupStats(w io.Writer) {
+    for _, name := range []string{"primeFactors", "primeFactorsHeavy"} {
+        peers := groupRings.Pool(name).Peers()
+        fmt.Fprintf(w, "Group %s pod set: [%d] %v\n", name, len(peers), peers)
+        writePeerStats(w, groupRings.Pool(name))
+    }
+}
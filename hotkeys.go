@@ -0,0 +1,66 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "sort"
+    "strconv"
+    "time"
+    "github.com/robwil/peer-aware-groupcache/ring"
+)
+
+// hotKeys holds the HotKeys of every ring which spreads its hot keys over replicas, keyed by ring name.
+var hotKeys = make(map[string]*ring.HotKeys)
+
+// hotKeyOptions returns the options described by the <prefix>_REPLICAS, <prefix>_THRESHOLD and <prefix>_WINDOW env
+// vars, e.g. HOT_KEY_REPLICAS=3, or nil if <prefix>_REPLICAS is not set, for hot keys to only be served by their
+// owner.
+func hotKeyOptions(prefix string) *ring.HotKeyOptions {
+    replicas := os.Getenv(prefix + "_REPLICAS")
+    if replicas == "" {
+        return nil
+    }
+    var opts ring.HotKeyOptions
+    var err error
+    if opts.Replicas, err = strconv.Atoi(replicas); err != nil {
+        log.Fatalf("error parsing %s_REPLICAS: %v", prefix, err)
+    }
+    if threshold := os.Getenv(prefix + "_THRESHOLD"); threshold != "" {
+        if opts.Threshold, err = strconv.Atoi(threshold); err != nil {
+            log.Fatalf("error parsing %s_THRESHOLD: %v", prefix, err)
+        }
+    }
+    if window := os.Getenv(prefix + "_WINDOW"); window != "" {
+        if opts.Window, err = time.ParseDuration(window); err != nil {
+            log.Fatalf("error parsing %s_WINDOW: %v", prefix, err)
+        }
+    }
+    return &opts
+}
+
+// withHotKeys has the groups of the named ring spread its hot keys over replicas, wrapping the ring's current
+// picker, unless opts is nil.
+func withHotKeys(rings *ring.Rings, ringName string, opts *ring.HotKeyOptions) {
+    if opts == nil {
+        return
+    }
+    h := ring.NewHotKeys(rings.Pool(ringName), rings.Picker(ringName), opts)
+    hotKeys[ringName] = h
+    rings.SetPicker(ringName, h)
+}
+
+func writeHotKeyStats(w io.Writer) {
+    names := make([]string, 0, len(hotKeys))
+    for name := range hotKeys {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        h := hotKeys[name]
+        opts := h.Options()
+        fmt.Fprintf(w, "Hot keys of %s (%d loads within %v, %d replicas): %v hot loads, %v from replicas\n", name,
+            opts.Threshold, opts.Window, opts.Replicas, h.Stats.HotLoads.String(), h.Stats.ReplicaLoads.String())
+    }
+}
@@ -1,15 +1,30 @@
 package main
 
 import (
+    "context"
     "fmt"
+    "io"
     "log"
+    "net"
     "strconv"
-    "github.com/golang/groupcache"
+    "github.com/robwil/peer-aware-groupcache/groupcache"
     "net/http"
+    "k8s.io/api/core/v1"
+    "k8s.io/apimachinery/pkg/api/resource"
     metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "github.com/robwil/peer-aware-groupcache/peerauth"
+    "github.com/robwil/peer-aware-groupcache/peerbind"
+    "github.com/robwil/peer-aware-groupcache/peertls"
     "github.com/robwil/peer-aware-groupcache/peerwatch"
-    "sort"
+    "github.com/robwil/peer-aware-groupcache/ring"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/peer"
+    "google.golang.org/grpc/status"
     "os"
+    "sort"
+    "strings"
+    "sync"
     "time"
 )
 
@@ -18,6 +33,16 @@ const Port = 5000
 // Get all prime factors of a given number n
 // Reference: https://siongui.github.io/2017/05/09/go-find-all-prime-factors-of-integer-number/
 func PrimeFactors(n int64) (pfs []int64) {
+    pfs, _ = primeFactors(context.Background(), n)
+    return
+}
+
+// cancelCheckInterval is how many trial divisions primeFactors does between checking whether it was canceled.
+const cancelCheckInterval = 1 << 16
+
+// primeFactors is PrimeFactors, giving up with ctx's error once ctx is done, since factoring a large prime
+// takes a long time and nobody may be waiting for the result any more.
+func primeFactors(ctx context.Context, n int64) (pfs []int64, err error) {
     // Get the number of 2s that divide n
     for n%2 == 0 {
         pfs = append(pfs, 2)
@@ -27,6 +52,11 @@ func PrimeFactors(n int64) (pfs []int64) {
     // n must be odd at this point. so we can skip one element
     // (note i = i + 2)
     for i := int64(3); i*i <= n; i = i + 2 {
+        if i%cancelCheckInterval == 1 {
+            if err := ctx.Err(); err != nil {
+                return nil, err
+            }
+        }
         // while i divides n, append i and divide n
         for n%i == 0 {
             pfs = append(pfs, i)
@@ -43,16 +73,21 @@ func PrimeFactors(n int64) (pfs []int64) {
     return
 }
 
-var PrimeFactorsGroup = groupcache.NewGroup("primeFactors", 1 << 20, groupcache.GetterFunc(func(ctx groupcache.Context, key string, dest groupcache.Sink) error {
+var primeFactorsGetter = groupcache.GetterFunc(func(ctx groupcache.Context, key string, dest groupcache.Sink) error {
     log.Printf("Calculating prime factors for %s", key)
     n, err := strconv.ParseInt(key, 10, 64)
     if err != nil {
         return err
     }
-    pfs := PrimeFactors(n)
+    pfs, err := primeFactors(ring.RequestContext(ctx), n)
+    if err != nil {
+        return err
+    }
     dest.SetString(fmt.Sprintf("%v", pfs))
     return nil
-}))
+})
+
+var PrimeFactorsGroup *groupcache.Group
 
 func Index(w http.ResponseWriter, _ *http.Request) {
     fmt.Fprintf(w, "Hello world\n")
@@ -60,14 +95,46 @@ func Index(w http.ResponseWriter, _ *http.Request) {
 
 func Factors(w http.ResponseWriter, r *http.Request) {
     nStr := r.FormValue("n")
+    group, ok := groupForRequest(r)
+    if !ok {
+        http.Error(w, "no such shard: "+r.FormValue("shard"), http.StatusNotFound)
+        return
+    }
     var b []byte
-    if err := PrimeFactorsGroup.Get(nil, nStr, groupcache.AllocatingByteSliceSink(&b)); err != nil {
+    if err := group.Get(r.Context(), groupKey(group, nStr), groupcache.AllocatingByteSliceSink(&b)); err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
         return
     }
     fmt.Fprintf(w, "%s\n", b)
 }
 
+// Remove removes the cached value of n from every pod, e.g. a bad value, so that it is computed again on its next
+// read. It only accepts POST and DELETE requests.
+func Remove(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" && r.Method != "DELETE" {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    nStr := r.FormValue("n")
+    group, ok := groupForRequest(r)
+    if !ok {
+        http.Error(w, "no such shard: "+r.FormValue("shard"), http.StatusNotFound)
+        return
+    }
+    groupPool := poolOf(group.Name())
+    if groupPool == nil {
+        // not spread over peers, only this pod caches it
+        group.Remove(groupKey(group, nStr))
+        w.WriteHeader(http.StatusNoContent)
+        return
+    }
+    if err := groupPool.Remove(r.Context(), group.Name(), groupKey(group, nStr)); err != nil {
+        http.Error(w, err.Error(), http.StatusBadGateway)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
 func Stats(w http.ResponseWriter, _ *http.Request) {
     stats := PrimeFactorsGroup.CacheStats(groupcache.MainCache)
     fmt.Fprintln(w, "Bytes:    ", stats.Bytes)
@@ -75,12 +142,227 @@ func Stats(w http.ResponseWriter, _ *http.Request) {
     fmt.Fprintln(w, "Gets:     ", stats.Gets)
     fmt.Fprintln(w, "Hits:     ", stats.Hits)
     fmt.Fprintln(w, "Evictions:", stats.Evictions)
+    fmt.Fprintln(w, "Expired:  ", stats.Expired)
+    fmt.Fprintln(w, "Loads from previous owner:", PrimeFactorsGroup.Stats.PreviousPeerLoads.String())
+    fmt.Fprintln(w, "Peer errors:", PrimeFactorsGroup.Stats.PeerErrors.String())
+    fmt.Fprintln(w, "Local fallbacks:", PrimeFactorsGroup.Stats.PeerFallbacks.String())
+    fmt.Fprintln(w, "Kept hot for peers:", PrimeFactorsGroup.Stats.HotKeeps.String())
+    fmt.Fprintln(w, "Removals:", PrimeFactorsGroup.Stats.Removes.String())
+    if generations != nil {
+        writeGenerationStats(w)
+    }
     fmt.Fprintln(w, "Self URL: ", selfUrl)
-    fmt.Fprintf(w, "Current pod set: [%d] %v\n", len(urlSet), urlSet)
+    if members != nil {
+        fmt.Fprintln(w, "Rejected non-member requests:", members.Rejected())
+    }
+    if peerSigner != nil {
+        fmt.Fprintf(w, "Signed peer requests: %v verified, %v bad signatures, %v bad timestamps\n",
+            peerSigner.Stats.Verified.String(), peerSigner.Stats.BadSignatures.String(), peerSigner.Stats.BadTimestamps.String())
+    }
+    if zoneAware != nil {
+        zoneAware.writeStats(w)
+    }
+    writeHotKeyStats(w)
+    writeBreakerStats(w)
+    peerClusters.writeStats(w)
+    writeRebalanceStats(w)
+    for _, b := range allBindings() {
+        if degraded, err, since := b.Degraded(); degraded {
+            fmt.Fprintf(w, "DEGRADED: %s running single-node since %v: %v\n", b.Name(), since.Format(time.RFC3339), err)
+        }
+    }
+    if shards != nil {
+        shards.writeStats(w)
+        return
+    }
+    if groupRings != nil {
+        writeGroupStats(w)
+        return
+    }
+    peers := binding.Peers()
+    fmt.Fprintf(w, "Current pod set: [%d] %v\n", len(peers), peers)
+    writePeerStats(w, pool)
+}
+
+// writeRebalanceStats writes the keys handed off by every rebalancer, in total.
+func writeRebalanceStats(w io.Writer) {
+    var runs, keys, bytes, errs int64
+    for _, r := range rebalancers {
+        runs += r.Stats.Runs.Get()
+        keys += r.Stats.KeysPushed.Get()
+        bytes += r.Stats.BytesPushed.Get()
+        errs += r.Stats.PushErrors.Get()
+    }
+    fmt.Fprintln(w, "Rebalances:      ", runs)
+    fmt.Fprintln(w, "Keys handed off: ", keys)
+    fmt.Fprintln(w, "Bytes handed off:", bytes)
+    fmt.Fprintln(w, "Handoff errors:  ", errs)
 }
 
-func getPodUrl(podIp string) string {
-    return fmt.Sprintf("http://%s:%d", podIp, Port)
+// getPodUrl builds the URL a pod serves groupcache requests on from its ip.
+var getPodUrl = peerbind.PeerURL("http", Port)
+
+// peerTLS is only set when peers talk over mutual TLS, and peerSigner when they sign their requests.
+var peerTLS *peertls.Reloader
+var peerSigner *peerauth.Signer
+
+// members is only set when peer requests are only served to current peers.
+var members *peerbind.Members
+
+// peerWriters decides which requests changing what is cached come from current peers, when they are not
+// authenticated otherwise (see allowPeerWrite). It is members, if set.
+var peerWriters *peerbind.Members
+
+// GRPCPort is the port peers serve each other on over gRPC, when using the gRPC peer transport.
+const GRPCPort = 5001
+
+// grpcServer is only set when peers load keys from each other over gRPC.
+var grpcServer *grpc.Server
+
+// ringStrategy returns the Strategy with the given name: consistent (the default), rendezvous or jump. Bounded loads
+// are refused for every ring, the heavy group's included: every ring here is one whose pods serve each other, and
+// a pod passed a key because its owner is loaded would forward it straight back (see ring.BoundedLoads).
+func ringStrategy(strategy string, replicas int) ring.Strategy {
+    switch strategy {
+    case "", "consistent":
+        return ring.Consistent{Replicas: replicas}
+    case "rendezvous":
+        return ring.Rendezvous{}
+    case "jump":
+        return ring.Jump{}
+    case "bounded":
+        log.Fatalf("ring strategy bounded is only meant for clients of the peers, not for rings whose pods serve each other")
+        return nil
+    default:
+        log.Fatalf("unknown ring strategy %q", strategy)
+        return nil
+    }
+}
+
+// ringOptions completes the options of a ring with the settings shared by every ring. Rings which do not pick their
+// own Strategy use RING_STRATEGY.
+func ringOptions(opts ring.Options) *ring.Options {
+    opts.PeerTimeout = PeerTimeout
+    if opts.Strategy == nil {
+        opts.Strategy = ringStrategy(os.Getenv("RING_STRATEGY"), opts.Replicas)
+    }
+    if grpcServer != nil {
+        opts.Getters = &ring.GRPCGetters{Port: GRPCPort}
+    }
+    if peerTLS != nil || peerSigner != nil {
+        transport := http.DefaultTransport
+        if peerTLS != nil {
+            transport = peerTLS
+        }
+        if peerSigner != nil {
+            transport = peerSigner.Transport(transport)
+        }
+        opts.Transport = func(groupcache.Context) http.RoundTripper { return transport }
+    }
+    return &opts
+}
+
+// peerWeigher returns the Weigher described by PEER_WEIGHTS: "annotation" to only weigh pods by their
+// peer-aware-groupcache/weight annotation, or "requests.<resource>" or "limits.<resource>" (e.g. "limits.memory") to
+// weigh them by their resources as well, in units of PEER_WEIGHT_UNIT (1Gi of memory, or 1 of anything else).
+func peerWeigher(from string, unit string) (peerwatch.Weigher, error) {
+    if from == "annotation" {
+        return peerwatch.Weigher{}, nil
+    }
+    parts := strings.SplitN(from, ".", 2)
+    if len(parts) != 2 || (parts[0] != "requests" && parts[0] != "limits") || parts[1] == "" {
+        return peerwatch.Weigher{}, fmt.Errorf("unknown peer weights %q", from)
+    }
+    weigher := peerwatch.Weigher{Resource: v1.ResourceName(parts[1]), Limits: parts[0] == "limits"}
+    if unit == "" {
+        unit = "1"
+        if weigher.Resource == v1.ResourceMemory {
+            unit = "1Gi"
+        }
+    }
+    var err error
+    weigher.Unit, err = resource.ParseQuantity(unit)
+    if err != nil {
+        return peerwatch.Weigher{}, fmt.Errorf("bad peer weight unit %q: %v", unit, err)
+    }
+    if weigher.Unit.Sign() <= 0 {
+        return peerwatch.Weigher{}, fmt.Errorf("peer weight unit %q is not positive", unit)
+    }
+    return weigher, nil
+}
+
+// weightedPeers is only set when peers own shares of keys proportional to their weights.
+var weightedPeers *peerWeights
+
+// peerWeights weighs the pods matching listOptions, for every ring to give them shares of keys proportional to
+// their weights.
+type peerWeights struct {
+    listOptions metav1.ListOptions
+    weigher     peerwatch.Weigher
+}
+
+// watch applies the weights of peers to every ring, and keeps doing so as they change.
+func (p *peerWeights) watch() {
+    if err := peerwatch.WatchWeights(p.listOptions, p.weigher, p.apply); err != nil {
+        // peers all weigh 1 until their weights can be listed
+        log.Printf("WARNING: error weighing peers: %v", err)
+    }
+}
+
+func (p *peerWeights) apply(weights map[string]float64) {
+    urls := make(map[string]float64, len(weights))
+    for ip, weight := range weights {
+        urls[getPodUrl(ip)] = weight
+    }
+    for _, pool := range allPools() {
+        pool.SetWeights(urls)
+    }
+}
+
+// allowPeerWrite only lets peers change what is cached (e.g. hand off keys) once they are authenticated, by mutual TLS
+// or signing as checked by the handlers wrapping ring.Handler, or else when they are current peers, whether or not
+// peer requests are only served to members.
+func allowPeerWrite(r *http.Request) bool {
+    if peerTLS != nil || peerSigner != nil {
+        return true
+    }
+    return peerWriters.Allows(r.RemoteAddr)
+}
+
+// adminOnly only serves handler to requests from the pod itself (e.g. through kubectl port-forward or exec), from
+// peers presenting their certificate when using mutual TLS, or from current peers, answering 403 otherwise: admin
+// endpoints change what every peer caches.
+func adminOnly(handler http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        host, _, err := net.SplitHostPort(r.RemoteAddr)
+        if err != nil {
+            host = r.RemoteAddr
+        }
+        ip := net.ParseIP(host)
+        local := ip != nil && ip.IsLoopback()
+        certified := peerTLS != nil && r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+        if !local && !certified && !peerWriters.Allows(r.RemoteAddr) {
+            http.Error(w, "admin requests are only served to peers", http.StatusForbidden)
+            return
+        }
+        handler.ServeHTTP(w, r)
+    })
+}
+
+// peerHandler serves the requests of peers, only from peers presenting their certificate when using mutual TLS,
+// only when signed with the shared secret when signing requests, and only from current peers if so configured.
+func peerHandler() http.Handler {
+    var handler http.Handler = &ring.Handler{AllowWrite: allowPeerWrite}
+    if peerSigner != nil {
+        handler = peerSigner.Verify(handler)
+    }
+    if peerTLS != nil {
+        handler = peertls.RequireClientCert(handler)
+    }
+    if members != nil {
+        handler = members.Handler(handler)
+    }
+    return life.peerHandler(handler)
 }
 
 func logRequest(handler http.Handler) http.Handler {
@@ -90,79 +372,409 @@ func logRequest(handler http.Handler) http.Handler {
     })
 }
 
-type UrlSet map[string]bool
-func (urlSet UrlSet) Keys() []string {
-    keys := make([]string, len(urlSet))
-    i := 0
-    for key := range urlSet {
-        keys[i] = key
-        i++
+var selfUrl string
+
+// pool and binding are only set when running a single ring.
+var pool *ring.Pool
+var binding *peerbind.Binding
+
+// rebalancers hand the keys of every ring off to their new owners, whichever way rings are set up.
+var rebalancers []*ring.Rebalancer
+
+// writePeerStats writes how often requests to each peer of pool failed.
+func writePeerStats(w io.Writer, pool *ring.Pool) {
+    stats := pool.PeerStats()
+    peers := make([]string, 0, len(stats))
+    for peer := range stats {
+        peers = append(peers, peer)
+    }
+    sort.Strings(peers)
+    weights := pool.Weights()
+    for _, peer := range peers {
+        s := stats[peer]
+        if weight, ok := weights[peer]; ok {
+            fmt.Fprintf(w, "Peer %s weighs %v\n", peer, weight)
+        }
+        fmt.Fprintf(w, "Peer %s: %v requests, %v errors (%.1f%% failed)\n", peer, s.Requests.String(), s.Errors.String(), 100*s.FailureRate())
     }
-    sort.Strings(keys)
-    return keys
 }
-func (urlSet UrlSet) String() string {
-    return fmt.Sprintf("%v", urlSet.Keys())
+
+// allPools returns the pools of every ring, whichever way they are set up.
+func allPools() []*ring.Pool {
+    var rings *ring.Rings
+    switch {
+    case shards != nil:
+        rings = shards.rings
+    case groupRings != nil:
+        rings = groupRings
+    case pool != nil:
+        return []*ring.Pool{pool}
+    default:
+        return nil
+    }
+    var pools []*ring.Pool
+    for _, pool := range rings.Pools() {
+        pools = append(pools, pool)
+    }
+    return pools
 }
 
-var selfUrl string
-var urlSet UrlSet
+// poolOf returns the pool the named group picks its peers from, whichever way rings are set up, or nil if there is
+// none.
+func poolOf(groupName string) *ring.Pool {
+    switch {
+    case shards != nil:
+        return shards.rings.PoolOf(groupName)
+    case groupRings != nil:
+        return groupRings.PoolOf(groupName)
+    }
+    return pool
+}
+
+// allBindings returns the bindings of every ring, whichever way they are set up.
+func allBindings() []*peerbind.Binding {
+    switch {
+    case shards != nil:
+        return shards.allBindings()
+    case groupRings != nil:
+        return groupRings.Bindings()
+    case binding != nil:
+        return []*peerbind.Binding{binding}
+    }
+    return nil
+}
 
 const DebugMode = true
 
+// PeerTimeout bounds every request to a peer, after which the key is computed locally instead.
+const PeerTimeout = 5 * time.Second
+
+// DefaultSlowCall is how long a request to a peer may take before it counts as failed for the peer's circuit, unless
+// PEER_SLOW_CALL says otherwise.
+const DefaultSlowCall = 2 * time.Second
+
+// breakerOptions returns the options of the circuit breaker of every ring, whose SlowCall is PEER_SLOW_CALL if set
+// (e.g. "1s", or "0" to only count errors).
+func breakerOptions() *ring.BreakerOptions {
+    slowCall := os.Getenv("PEER_SLOW_CALL")
+    if slowCall == "" {
+        return &ring.BreakerOptions{SlowCall: DefaultSlowCall}
+    }
+    d, err := time.ParseDuration(slowCall)
+    if err != nil {
+        log.Fatalf("error parsing PEER_SLOW_CALL: %v", err)
+    }
+    return &ring.BreakerOptions{SlowCall: d}
+}
+
+// PeerFallback computes keys locally when their owner fails, without caching them: the owner remains
+// responsible for them once it recovers.
+const PeerFallback = groupcache.FallbackNoPopulate
+
+// TransitionWindow is how long keys are fetched from their previous owner after the ring changes.
+const TransitionWindow = 30 * time.Second
+
+// groupTTL returns how long values live in every group once loaded, from the GROUP_TTL env var (e.g. "10m"), or 0
+// for values which never expire.
+func groupTTL() time.Duration {
+    ttl := os.Getenv("GROUP_TTL")
+    if ttl == "" {
+        return 0
+    }
+    d, err := time.ParseDuration(ttl)
+    if err != nil {
+        log.Fatalf("error parsing GROUP_TTL: %v", err)
+    }
+    return d
+}
+
+// checkMembership refuses MEMBERSHIP_MODE=heartbeat and PEER_CLUSTER_CONTEXTS alongside HEAVY_SELECTOR or
+// SHARD_LABEL: the rings of groups and shards hold the pods matching their label selectors, which only watching the
+// pods of the current cluster can tell, and heartbeats carry no labels.
+func checkMembership() {
+    var membership string
+    if os.Getenv("MEMBERSHIP_MODE") == "heartbeat" {
+        membership = "heartbeat membership"
+    } else if os.Getenv("PEER_CLUSTER_CONTEXTS") != "" {
+        membership = "peers in several clusters"
+    } else {
+        return
+    }
+    if os.Getenv("HEAVY_SELECTOR") != "" {
+        log.Fatalf("%s is not supported with a heavy group (HEAVY_SELECTOR), which picks its pods by label", membership)
+    }
+    if os.Getenv("SHARD_LABEL") != "" {
+        log.Fatalf("%s is not supported with shards (SHARD_LABEL), which pick their pods by label", membership)
+    }
+}
+
+// heartbeats is the source of peers of the single ring with heartbeat membership, nil otherwise.
+var heartbeats *peerwatch.HeartbeatSource
+
+// leaveRing removes the current pod's heartbeat when shutting down, for peers to stop routing to it right away
+// rather than once the heartbeat expires. Peers watching pods already notice once it is marked unready.
+func leaveRing() {
+    if heartbeats == nil {
+        return
+    }
+    if err := heartbeats.Leave(); err != nil {
+        log.Printf("WARNING: could not remove heartbeat: %v", err)
+    }
+}
+
+// membershipSource picks how peers of the single ring are discovered.
+func membershipSource(listOptions metav1.ListOptions) peerwatch.Source {
+    if os.Getenv("MEMBERSHIP_MODE") == "heartbeat" {
+        // Heartbeat membership only needs access to a single ConfigMap, for namespaces where listing pods is forbidden
+        heartbeats = &peerwatch.HeartbeatSource{Options: peerwatch.HeartbeatOptions{
+            ConfigMapName: os.Getenv("HEARTBEAT_CONFIGMAP"),
+            PeerURL:       getPodUrl,
+        }}
+        return heartbeats
+    }
+    if contexts := os.Getenv("PEER_CLUSTER_CONTEXTS"); contexts != "" {
+        // Merge peers from several clusters (sharing a flat pod network) into a single ring
+        var clusters []peerwatch.Cluster
+        for _, context := range strings.Split(contexts, ",") {
+            cluster, err := peerwatch.NewClusterFromKubeconfig(context, os.Getenv("PEER_KUBECONFIG"), context)
+            if err != nil {
+                log.Fatalf("error loading kubeconfig context %s: %v", context, err)
+            }
+            clusters = append(clusters, cluster)
+        }
+        return peerwatch.MultiClusterSource{Clusters: clusters, ListOptions: listOptions, OnPeer: peerClusters.notify}
+    }
+    return peerwatch.PodSource{ListOptions: listOptions}
+}
+
+// clusterMap keeps track of the cluster each peer was discovered in, when peers are discovered in several clusters.
+type clusterMap struct {
+    mu       sync.Mutex
+    clusters map[string]string // cluster name, keyed by peer ip
+}
+
+var peerClusters = &clusterMap{clusters: make(map[string]string)}
+
+func (c *clusterMap) notify(peer peerwatch.Peer, state peerwatch.NotifyState) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    switch state {
+    case peerwatch.Added:
+        c.clusters[peer.IP] = peer.Cluster
+    case peerwatch.Removed:
+        delete(c.clusters, peer.IP)
+    }
+}
+
+// writeStats writes the peers of every cluster, if there are any.
+func (c *clusterMap) writeStats(w io.Writer) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    byCluster := make(map[string][]string)
+    for ip, cluster := range c.clusters {
+        byCluster[cluster] = append(byCluster[cluster], ip)
+    }
+    names := make([]string, 0, len(byCluster))
+    for name := range byCluster {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        ips := byCluster[name]
+        sort.Strings(ips)
+        fmt.Fprintf(w, "Cluster %s peers: [%d] %v\n", name, len(ips), ips)
+    }
+}
+
 func main() {
-    urlSet = make(UrlSet)
-    myIp := os.Getenv("MY_POD_IP")
+    myIp, err := peerbind.SelfIP()
+    if err != nil {
+        log.Fatalf("error detecting own ip: %v", err)
+    }
+    if dir := os.Getenv("PEER_TLS_DIR"); dir != "" {
+        // Peers authenticate each other with the certificates mounted in dir, and talk over https
+        peerTLS, err = peertls.Load(peertls.DirConfig(dir, os.Getenv("PEER_TLS_SERVER_NAME")))
+        if err != nil {
+            log.Fatalf("error loading peer certificates: %v", err)
+        }
+        getPodUrl = peerbind.PeerURL("https", Port)
+    }
+    if dir := os.Getenv("PEER_SECRET_DIR"); dir != "" {
+        // Peers sign their requests with the shared secret mounted in dir
+        peerSigner, err = peerauth.Load(peerauth.DirConfig(dir, ring.DefaultBasePath))
+        if err != nil {
+            log.Fatalf("error loading peer secret: %v", err)
+        }
+    }
+    if os.Getenv("PEER_MEMBERS_ONLY") == "true" {
+        // Only serve peer requests to discovered peers, and to the addresses in PEER_ALLOW_CIDRS
+        allow, err := peerbind.ParseCIDRs(os.Getenv("PEER_ALLOW_CIDRS"))
+        if err != nil {
+            log.Fatalf("error parsing PEER_ALLOW_CIDRS: %v", err)
+        }
+        members = peerbind.NewMembers(allBindings, allow)
+    }
+    peerWriters = members
+    if peerWriters == nil {
+        peerWriters = peerbind.NewMembers(allBindings, nil)
+    }
+    if os.Getenv("PEER_TRANSPORT") == "grpc" {
+        // Load keys from peers over long-lived gRPC connections rather than an HTTP request per key
+        if peerTLS != nil || peerSigner != nil {
+            log.Fatalf("the gRPC peer transport does not support peer TLS or signed peer requests yet")
+        }
+        grpcServer = grpc.NewServer(grpc.UnaryInterceptor(grpcPeerInterceptor))
+        ring.RegisterGRPCServer(grpcServer)
+    }
+    selfUrl = getPodUrl(myIp)
     listOptions := metav1.ListOptions{LabelSelector: "app=peer-aware-groupcache"}
-
-    var pool *groupcache.HTTPPool
-    initialized := false
-    initialPeers, err := peerwatch.Init(myIp, listOptions, func(ip string, state peerwatch.NotifyState) {
-        for !initialized {
-            // prevent race condition by waiting for initial peers to be setup before processing any changes
-            time.Sleep(100 * time.Millisecond)
-        }
-        if DebugMode {
-            log.Printf("Got notify: %s [%d]", ip, state)
-        }
-        switch state {
-        case peerwatch.Added:
-            urlSet[getPodUrl(ip)] = true
-        case peerwatch.Removed:
-            delete(urlSet, getPodUrl(ip))
-        default:
-            return
+    peerwatch.SetDebugMode(DebugMode)
+    if from := os.Getenv("PEER_WEIGHTS"); from != "" {
+        // Larger pods own proportionally more keys
+        weigher, err := peerWeigher(from, os.Getenv("PEER_WEIGHT_UNIT"))
+        if err != nil {
+            log.Fatalf("error parsing PEER_WEIGHTS: %v", err)
         }
-        podUrls := urlSet.Keys()
-        log.Printf("New pod list = %v", podUrls)
-        pool.Set(podUrls...)
-    }, DebugMode)
+        weightedPeers = &peerWeights{listOptions: listOptions, weigher: weigher}
+    }
+    if os.Getenv("ZONE_AWARE") == "true" {
+        // Count fetches from peers in other zones, and optionally keep hot keys within each zone
+        zoneAware = &peerZones{listOptions: listOptions, pickers: make(map[string]*ring.Zones)}
+        zoneAware.opts.Replicate = os.Getenv("ZONE_REPLICATE_HOT_KEYS") == "true"
+        if threshold := os.Getenv("ZONE_HOT_THRESHOLD"); threshold != "" {
+            zoneAware.opts.HotThreshold, err = strconv.Atoi(threshold)
+            if err != nil {
+                log.Fatalf("error parsing ZONE_HOT_THRESHOLD: %v", err)
+            }
+        }
+    }
+
+    if generationConfigMap = os.Getenv("GENERATION_CONFIGMAP"); generationConfigMap != "" {
+        // Bumping the generation of a group, stored in a ConfigMap every pod watches, retires all of its cached values
+        generations = ring.NewGenerations()
+    }
+
+    checkMembership()
+    if heavySelector := os.Getenv("HEAVY_SELECTOR"); heavySelector != "" {
+        // Heavy numbers get a group of their own, spread only over the pods matching HEAVY_SELECTOR
+        setupGroups(myIp, listOptions, metav1.ListOptions{LabelSelector: heavySelector})
+        serve()
+        return
+    }
+
+    PrimeFactorsGroup = groupcache.NewGroup("primeFactors", 1 << 20, groupGetter())
+    PrimeFactorsGroup.SetPeerFallback(PeerFallback)
+    PrimeFactorsGroup.SetTTL(groupTTL())
+    if shardLabel := os.Getenv("SHARD_LABEL"); shardLabel != "" {
+        // Independent rings per shard, rather than a single HTTPPool for every pod
+        setupShards(myIp, os.Getenv("MY_SHARD"), listOptions, shardLabel, strings.Split(os.Getenv("SHARDS"), ","))
+        serve()
+        return
+    }
+
+    // Keys which moved when pods come and go are fetched from their previous owner's cache for a while
+    pool = ring.NewPool(selfUrl, ringOptions(ring.Options{TransitionWindow: TransitionWindow}))
+    rings := ring.NewRings()
+    rings.Add("primeFactors", pool)
+    withBreaker(rings, "primeFactors")
+    withHotKeys(rings, "primeFactors", hotKeyOptions("HOT_KEY"))
+    withZones(rings, "primeFactors")
+    rings.Bind("primeFactors", "primeFactors")
+    http.Handle(ring.DefaultBasePath, peerHandler())
+    // Hand cached keys off to their new owners whenever pods come and go
+    rebalancers = append(rebalancers, ring.NewRebalancer(pool, []*groupcache.Group{PrimeFactorsGroup}, nil))
+    binding, err = peerbind.Bind("primeFactors", membershipSource(listOptions), pool, myIp, getPodUrl)
     if err != nil {
-        // Setup groupcache with just self as peer
+        // groupcache is setup with just self as peer, until discovery recovers in the background
         log.Printf("WARNING: error getting initial pods: %v", err)
-        url := fmt.Sprintf("http://0.0.0.0:%d", Port)
-        urlSet[url] = true
-        pool = groupcache.NewHTTPPool(url)
-        pool.Set(url)
-        initialized = true
-    } else {
-        for _, ip := range initialPeers {
-            urlSet[getPodUrl(ip)] = true
-        }
-        selfUrl = getPodUrl(myIp)
-        podUrls := urlSet.Keys()
-        pool = groupcache.NewHTTPPool(selfUrl)
-        pool.Set(podUrls...)
-        initialized = true
     }
 
+    serve()
+}
+
+func serve() {
+    if weightedPeers != nil {
+        weightedPeers.watch()
+    }
+    if zoneAware != nil {
+        zoneAware.watch()
+    }
+    if generations != nil {
+        watchGenerations()
+    }
     // Setup http routes
     http.HandleFunc("/", Index)
-    http.HandleFunc("/factors", Factors)
+    http.Handle("/factors", life.track(http.HandlerFunc(Factors)))
+    http.Handle("/remove", adminOnly(life.track(http.HandlerFunc(Remove))))
+    http.Handle("/generation", adminOnly(http.HandlerFunc(Generation)))
     http.HandleFunc("/stats", Stats)
+    http.Handle("/status", peerbind.StatusHandler(allBindings))
+    http.HandleFunc("/ready", Ready)
+    http.HandleFunc("/prestop", PreStop)
 
     log.Printf("Listening on port %d...", Port)
-    if err := http.ListenAndServe(fmt.Sprintf("0.0.0.0:%d", Port), logRequest(http.DefaultServeMux)); err != nil {
-        log.Fatalf("error in ListenAndServe: %s", err)
+    server := &http.Server{
+        Addr:    fmt.Sprintf("0.0.0.0:%d", Port),
+        Handler: logRequest(http.DefaultServeMux),
+    }
+    if peerTLS != nil {
+        server.TLSConfig = peerTLS.ServerConfig()
+    }
+    if grpcServer != nil {
+        listener, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", GRPCPort))
+        if err != nil {
+            log.Fatalf("error listening for gRPC peers: %v", err)
+        }
+        log.Printf("Serving peers over gRPC on port %d...", GRPCPort)
+        go grpcServer.Serve(listener)
+    }
+    serveUntilSignalled(server, handOff, stopGRPC)
+}
+
+// stopGRPC stops serving peers over gRPC once their requests in flight are done, or right away once ctx is done.
+func stopGRPC(ctx context.Context) {
+    if grpcServer == nil {
+        return
+    }
+    stopped := make(chan struct{})
+    go func() {
+        grpcServer.GracefulStop()
+        close(stopped)
+    }()
+    select {
+    case <-stopped:
+    case <-ctx.Done():
+        log.Printf("WARNING: gave up stopping the gRPC server gracefully: %v", ctx.Err())
+        grpcServer.Stop()
+    }
+}
+
+// handOff streams the most valuable cached entries to the peers taking them over, before shutting down,
+// so that scaling down does not cause a storm of cache misses.
+func handOff(ctx context.Context) {
+    // the rings drain at once, sharing the time left to hand off
+    var wg sync.WaitGroup
+    for _, r := range rebalancers {
+        wg.Add(1)
+        go func(r *ring.Rebalancer) {
+            defer wg.Done()
+            r.Drain(ctx)
+        }(r)
     }
-}
\ No newline at end of file
+    wg.Wait()
+}
+
+// grpcPeerInterceptor applies to gRPC peer requests what peerHandler applies to HTTP ones: it turns them away while
+// draining, and when they do not come from a current peer.
+func grpcPeerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+    if life.isDraining() {
+        return nil, status.Error(codes.Unavailable, "shutting down")
+    }
+    if members != nil {
+        p, ok := peer.FromContext(ctx)
+        if !ok || !members.Allows(p.Addr.String()) {
+            return nil, status.Error(codes.PermissionDenied, "not a peer")
+        }
+    }
+    return handler(ctx, req)
+}
@@ -0,0 +1,282 @@
+// Package peerauth authenticates the requests between cache peers with a shared secret, as a lighter alternative
+// to mutual TLS (see peertls).
+//
+// Every request carries a timestamp and an HMAC-SHA256 over that timestamp and everything the request does: its
+// method, the group and key it is for, its query, the expiry of the value it hands off and a hash of its body. Only
+// holders of the secret can make peer requests, a captured request cannot be replayed as another one (e.g. a GET
+// as a PUT writing another value), and captured requests stop being accepted once the allowed clock skew has
+// passed. Secrets are read from files (e.g. a mounted Kubernetes Secret) and reloaded when
+// they change. To rotate the secret without rejecting requests, the new secret is added alongside the current one
+// first, since requests are accepted when signed with either of them.
+package peerauth
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "io"
+    "io/ioutil"
+    "log"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "github.com/robwil/peer-aware-groupcache/groupcache"
+    "github.com/robwil/peer-aware-groupcache/ring"
+)
+
+const (
+    // TimestampHeader and SignatureHeader carry the signature of a peer request.
+    TimestampHeader = "X-Groupcache-Timestamp"
+    SignatureHeader = "X-Groupcache-Signature"
+
+    defaultMaxSkew        = 30 * time.Second
+    defaultReloadInterval = 30 * time.Second
+)
+
+// Config locates the shared secrets.
+type Config struct {
+    // SecretFile holds the secret requests are signed with.
+    SecretFile string
+    // PreviousSecretFile optionally holds a second secret which requests are accepted with as well, e.g. the
+    // secret being rotated out. A missing file is ignored.
+    PreviousSecretFile string
+    // BasePath is the HTTP path peers serve groupcache requests on, e.g. ring.DefaultBasePath.
+    BasePath string
+    // MaxSkew is how far the timestamp of a request may be from the current time. Defaults to 30 seconds.
+    MaxSkew time.Duration
+    // ReloadInterval is how often the files are checked for changes. Defaults to 30 seconds.
+    ReloadInterval time.Duration
+}
+
+// DirConfig returns the Config of a directory holding the files current and, optionally, previous, as mounted
+// from a Kubernetes Secret with those keys.
+func DirConfig(dir string, basePath string) Config {
+    return Config{
+        SecretFile:         filepath.Join(dir, "current"),
+        PreviousSecretFile: filepath.Join(dir, "previous"),
+        BasePath:           basePath,
+    }
+}
+
+// Stats are statistics on the requests verified by a Signer.
+type Stats struct {
+    Verified      groupcache.AtomicInt
+    BadSignatures groupcache.AtomicInt // including missing ones
+    BadTimestamps groupcache.AtomicInt // missing, or off by more than MaxSkew
+}
+
+// Signer signs the requests of the current peer and verifies those of its peers.
+type Signer struct {
+    config Config
+
+    mu      sync.RWMutex // guards secrets
+    secrets [][]byte     // the one to sign with first
+
+    Stats Stats
+}
+
+// Load reads the secrets of config, and keeps reloading them in the background whenever they change. If a reload
+// fails the previous secrets are kept.
+func Load(config Config) (*Signer, error) {
+    if config.SecretFile == "" {
+        return nil, errors.New("peer request signing requires a secret file")
+    }
+    if config.MaxSkew <= 0 {
+        config.MaxSkew = defaultMaxSkew
+    }
+    if config.ReloadInterval <= 0 {
+        config.ReloadInterval = defaultReloadInterval
+    }
+    s := &Signer{config: config}
+    if _, err := s.reload(); err != nil {
+        return nil, err
+    }
+    go s.watch()
+    return s, nil
+}
+
+func (s *Signer) watch() {
+    ticker := time.NewTicker(s.config.ReloadInterval)
+    defer ticker.Stop()
+    for range ticker.C {
+        changed, err := s.reload()
+        if err != nil {
+            log.Printf("WARNING: error reloading peer secrets, keeping the previous ones: %v", err)
+        } else if changed {
+            log.Printf("Reloaded peer secrets")
+        }
+    }
+}
+
+// reload reads the secrets again, returning whether they changed.
+func (s *Signer) reload() (bool, error) {
+    secret, err := readSecret(s.config.SecretFile)
+    if err != nil {
+        return false, err
+    }
+    if len(secret) == 0 {
+        return false, errors.New("empty secret in " + s.config.SecretFile)
+    }
+    secrets := [][]byte{secret}
+    if s.config.PreviousSecretFile != "" {
+        previous, err := readSecret(s.config.PreviousSecretFile)
+        if err != nil && !os.IsNotExist(err) {
+            return false, err
+        }
+        if len(previous) > 0 && !bytes.Equal(previous, secret) {
+            secrets = append(secrets, previous)
+        }
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if len(secrets) == len(s.secrets) && bytes.Equal(bytes.Join(secrets, nil), bytes.Join(s.secrets, nil)) {
+        return false, nil
+    }
+    s.secrets = secrets
+    return true, nil
+}
+
+func readSecret(file string) ([]byte, error) {
+    b, err := ioutil.ReadFile(file)
+    if err != nil {
+        return nil, err
+    }
+    return bytes.TrimSpace(b), nil
+}
+
+// signature returns the hex encoded HMAC of a request made at timestamp, for groupAndKey (the request path below
+// BasePath, e.g. "primeFactors/12345"), with the given body.
+func signature(secret []byte, timestamp string, r *http.Request, groupAndKey string, body []byte) string {
+    bodyHash := sha256.Sum256(body)
+    mac := hmac.New(sha256.New, secret)
+    for _, part := range []string{
+        timestamp,
+        r.Method,
+        groupAndKey,
+        r.URL.RawQuery,
+        r.Header.Get(ring.ExpireHeader),
+        hex.EncodeToString(bodyHash[:]),
+    } {
+        mac.Write([]byte(part))
+        mac.Write([]byte{'\n'})
+    }
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+// readBody reads the body of r, leaving it in place to be read again.
+func readBody(body *io.ReadCloser) ([]byte, error) {
+    if *body == nil || *body == http.NoBody {
+        return nil, nil
+    }
+    b, err := ioutil.ReadAll(*body)
+    (*body).Close()
+    if err != nil {
+        return nil, err
+    }
+    *body = ioutil.NopCloser(bytes.NewReader(b))
+    return b, nil
+}
+
+func (s *Signer) groupAndKey(r *http.Request) (string, bool) {
+    if !strings.HasPrefix(r.URL.Path, s.config.BasePath) {
+        return "", false
+    }
+    return r.URL.Path[len(s.config.BasePath):], true
+}
+
+// Transport returns an http.RoundTripper signing every request to a peer before making it with next.
+func (s *Signer) Transport(next http.RoundTripper) http.RoundTripper {
+    return signingTransport{signer: s, next: next}
+}
+
+type signingTransport struct {
+    signer *Signer
+    next   http.RoundTripper
+}
+
+func (t signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    groupAndKey, ok := t.signer.groupAndKey(req)
+    if !ok {
+        return t.next.RoundTrip(req)
+    }
+    t.signer.mu.RLock()
+    secret := t.signer.secrets[0]
+    t.signer.mu.RUnlock()
+
+    // RoundTrippers must not modify the request they are given
+    signed := new(http.Request)
+    *signed = *req
+    signed.Header = make(http.Header, len(req.Header)+2)
+    for name, values := range req.Header {
+        signed.Header[name] = values
+    }
+    body, err := readBody(&signed.Body)
+    if err != nil {
+        return nil, err
+    }
+    if body != nil {
+        signed.GetBody = func() (io.ReadCloser, error) {
+            return ioutil.NopCloser(bytes.NewReader(body)), nil
+        }
+    }
+    timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+    signed.Header.Set(TimestampHeader, timestamp)
+    signed.Header.Set(SignatureHeader, signature(secret, timestamp, signed, groupAndKey, body))
+    return t.next.RoundTrip(signed)
+}
+
+// Verify only lets requests through to handler which were signed with one of the current secrets within MaxSkew
+// of the current time, answering 403 otherwise.
+func (s *Signer) Verify(handler http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if err := s.verify(r); err != nil {
+            http.Error(w, err.Error(), http.StatusForbidden)
+            return
+        }
+        s.Stats.Verified.Add(1)
+        handler.ServeHTTP(w, r)
+    })
+}
+
+func (s *Signer) verify(r *http.Request) error {
+    timestamp := r.Header.Get(TimestampHeader)
+    seconds, err := strconv.ParseInt(timestamp, 10, 64)
+    if err != nil {
+        s.Stats.BadTimestamps.Add(1)
+        return errors.New("missing or malformed request timestamp")
+    }
+    if skew := time.Since(time.Unix(seconds, 0)); skew > s.config.MaxSkew || skew < -s.config.MaxSkew {
+        s.Stats.BadTimestamps.Add(1)
+        return errors.New("request timestamp too far from the current time")
+    }
+
+    groupAndKey, ok := s.groupAndKey(r)
+    got, err := hex.DecodeString(r.Header.Get(SignatureHeader))
+    if !ok || err != nil || len(got) == 0 {
+        s.Stats.BadSignatures.Add(1)
+        return errors.New("missing or malformed request signature")
+    }
+    body, err := readBody(&r.Body)
+    if err != nil {
+        s.Stats.BadSignatures.Add(1)
+        return err
+    }
+    s.mu.RLock()
+    secrets := s.secrets
+    s.mu.RUnlock()
+    for _, secret := range secrets {
+        want, _ := hex.DecodeString(signature(secret, timestamp, r, groupAndKey, body))
+        if hmac.Equal(got, want) {
+            return nil
+        }
+    }
+    s.Stats.BadSignatures.Add(1)
+    return errors.New("bad request signature")
+}
@@ -0,0 +1,160 @@
+package peerauth_test
+
+import (
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+    "github.com/robwil/peer-aware-groupcache/peerauth"
+    "github.com/robwil/peer-aware-groupcache/ring"
+)
+
+// loadSigner loads a Signer of the secret current, and of previous as well if not empty.
+func loadSigner(t *testing.T, current string, previous string) *peerauth.Signer {
+    dir, err := ioutil.TempDir("", "peerauth")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { os.RemoveAll(dir) })
+    if err := ioutil.WriteFile(filepath.Join(dir, "current"), []byte(current+"\n"), 0600); err != nil {
+        t.Fatal(err)
+    }
+    if previous != "" {
+        if err := ioutil.WriteFile(filepath.Join(dir, "previous"), []byte(previous), 0600); err != nil {
+            t.Fatal(err)
+        }
+    }
+    signer, err := peerauth.Load(peerauth.DirConfig(dir, ring.DefaultBasePath))
+    if err != nil {
+        t.Fatal(err)
+    }
+    return signer
+}
+
+// recorder keeps the last request it was given instead of making it.
+type recorder struct {
+    req  *http.Request
+    body string
+}
+
+func (r *recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+    r.req = req
+    if req.Body != nil {
+        b, err := ioutil.ReadAll(req.Body)
+        if err != nil {
+            return nil, err
+        }
+        r.body = string(b)
+    }
+    return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+}
+
+// sign returns the signature headers signer adds to a request.
+func sign(t *testing.T, signer *peerauth.Signer, method string, url string, body string, expire string) http.Header {
+    req := httptest.NewRequest(method, url, strings.NewReader(body))
+    req.RequestURI = ""
+    if expire != "" {
+        req.Header.Set(ring.ExpireHeader, expire)
+    }
+    rec := &recorder{}
+    if _, err := signer.Transport(rec).RoundTrip(req); err != nil {
+        t.Fatal(err)
+    }
+    if rec.body != body {
+        t.Fatalf("signed request has body %q, want %q", rec.body, body)
+    }
+    return rec.req.Header
+}
+
+// verify returns the status a Signer verifying with signer answers a request with.
+func verify(signer *peerauth.Signer, method string, url string, body string, header http.Header) int {
+    req := httptest.NewRequest(method, url, strings.NewReader(body))
+    for name, values := range header {
+        req.Header[name] = values
+    }
+    w := httptest.NewRecorder()
+    signer.Verify(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        b, _ := ioutil.ReadAll(r.Body)
+        if string(b) != body {
+            http.Error(w, "body not passed on", http.StatusInternalServerError)
+        }
+    })).ServeHTTP(w, req)
+    return w.Code
+}
+
+func TestVerify(t *testing.T) {
+    signer := loadSigner(t, "secret", "")
+    const url = "http://peer" + ring.DefaultBasePath + "primeFactors/12"
+    get := sign(t, signer, "GET", url, "", "")
+    put := sign(t, signer, "PUT", url, "value", "1000")
+
+    tests := []struct {
+        name   string
+        method string
+        url    string
+        body   string
+        header http.Header
+        want   int
+    }{
+        {"signed get", "GET", url, "", get, http.StatusOK},
+        {"signed put", "PUT", url, "value", put, http.StatusOK},
+        {"get replayed as a put", "PUT", url, "value", get, http.StatusForbidden},
+        {"get replayed as a delete", "DELETE", url, "", get, http.StatusForbidden},
+        {"get replayed as a peek", "GET", url + "?peek=1", "", get, http.StatusForbidden},
+        {"get replayed for another key", "GET", url + "3", "", get, http.StatusForbidden},
+        {"put with another body", "PUT", url, "poison", put, http.StatusForbidden},
+        {"unsigned", "GET", url, "", nil, http.StatusForbidden},
+    }
+    for _, test := range tests {
+        if got := verify(signer, test.method, test.url, test.body, test.header); got != test.want {
+            t.Errorf("%s: got %d, want %d", test.name, got, test.want)
+        }
+    }
+
+    t.Run("put with another expiry", func(t *testing.T) {
+        header := http.Header{}
+        for name, values := range put {
+            header[name] = values
+        }
+        header.Set(ring.ExpireHeader, "2000")
+        if got := verify(signer, "PUT", url, "value", header); got != http.StatusForbidden {
+            t.Errorf("got %d, want 403", got)
+        }
+    })
+
+    t.Run("stale timestamp", func(t *testing.T) {
+        header := http.Header{}
+        for name, values := range get {
+            header[name] = values
+        }
+        header.Set(peerauth.TimestampHeader, strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10))
+        if got := verify(signer, "GET", url, "", header); got != http.StatusForbidden {
+            t.Errorf("got %d, want 403", got)
+        }
+        if signer.Stats.BadTimestamps.Get() == 0 {
+            t.Error("stale timestamp not counted")
+        }
+    })
+}
+
+func TestRotation(t *testing.T) {
+    const url = "http://peer" + ring.DefaultBasePath + "primeFactors/12"
+    old := loadSigner(t, "old", "")
+    rotating := loadSigner(t, "new", "old")
+    other := loadSigner(t, "other", "")
+
+    if got := verify(rotating, "GET", url, "", sign(t, old, "GET", url, "", "")); got != http.StatusOK {
+        t.Errorf("request signed with the previous secret: got %d, want 200", got)
+    }
+    if got := verify(old, "GET", url, "", sign(t, rotating, "GET", url, "", "")); got != http.StatusForbidden {
+        t.Errorf("request signed with a secret the verifier does not have yet: got %d, want 403", got)
+    }
+    if got := verify(rotating, "GET", url, "", sign(t, other, "GET", url, "", "")); got != http.StatusForbidden {
+        t.Errorf("request signed with another secret: got %d, want 403", got)
+    }
+}
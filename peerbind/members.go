@@ -0,0 +1,100 @@
+package peerbind
+
+import (
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "strings"
+    "sync/atomic"
+)
+
+// IsMember returns whether ip is one of the binding's current peers (including the current pod).
+func (b *Binding) IsMember(ip string) bool {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    _, ok := b.urls[ip]
+    return ok
+}
+
+// ParseCIDRs parses a comma separated list of CIDRs, e.g. "10.1.0.0/16,192.168.0.0/24". Empty entries are ignored.
+func ParseCIDRs(s string) ([]*net.IPNet, error) {
+    var nets []*net.IPNet
+    for _, cidr := range strings.Split(s, ",") {
+        cidr = strings.TrimSpace(cidr)
+        if cidr == "" {
+            continue
+        }
+        _, ipNet, err := net.ParseCIDR(cidr)
+        if err != nil {
+            return nil, fmt.Errorf("bad CIDR %q: %v", cidr, err)
+        }
+        nets = append(nets, ipNet)
+    }
+    return nets, nil
+}
+
+// Members decides whether requests of the peer protocol come from a current peer, so that clients cannot bypass
+// the service's public API and call the getter directly.
+//
+// Membership is as discovered by the current pod, so requests from a peer which just joined may be rejected until
+// the current pod notices it; such peers then load the keys themselves, as when any peer request fails.
+type Members struct {
+    bindings func() []*Binding
+    allow    []*net.IPNet
+    rejected int64
+}
+
+// NewMembers creates a Members admitting the current peers of any of the bindings, and any address within allow
+// (e.g. for peers behind NAT).
+func NewMembers(bindings func() []*Binding, allow []*net.IPNet) *Members {
+    return &Members{bindings: bindings, allow: allow}
+}
+
+// Allows returns whether a request from remoteAddr (an ip, optionally with a port) comes from a member, counting
+// and logging it as rejected otherwise.
+func (m *Members) Allows(remoteAddr string) bool {
+    host, _, err := net.SplitHostPort(remoteAddr)
+    if err != nil {
+        host = remoteAddr
+    }
+    if m.isMember(host) {
+        return true
+    }
+    atomic.AddInt64(&m.rejected, 1)
+    log.Printf("WARNING: rejected peer request from non-member %s", host)
+    return false
+}
+
+func (m *Members) isMember(host string) bool {
+    if ip := net.ParseIP(host); ip != nil {
+        for _, ipNet := range m.allow {
+            if ipNet.Contains(ip) {
+                return true
+            }
+        }
+    }
+    for _, b := range m.bindings() {
+        if b != nil && b.IsMember(host) {
+            return true
+        }
+    }
+    return false
+}
+
+// Rejected returns the number of requests rejected so far.
+func (m *Members) Rejected() int64 {
+    return atomic.LoadInt64(&m.rejected)
+}
+
+// Handler wraps the handler of the peer protocol (e.g. *groupcache.HTTPPool) so that it only serves requests from
+// members, answering 403 otherwise.
+func (m *Members) Handler(handler http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !m.Allows(r.RemoteAddr) {
+            http.Error(w, "not a peer: "+r.RemoteAddr, http.StatusForbidden)
+            return
+        }
+        handler.ServeHTTP(w, r)
+    })
+}
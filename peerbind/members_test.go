@@ -0,0 +1,80 @@
+package peerbind_test
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "github.com/robwil/peer-aware-groupcache/peerbind"
+    "github.com/robwil/peer-aware-groupcache/peerwatch"
+)
+
+// staticSource starts with fixed peers, and keeps f for the test to notify changes.
+type staticSource struct {
+    ips []string
+    f   peerwatch.NotifyFunc
+}
+
+func (s *staticSource) Start(myIp string, f peerwatch.NotifyFunc) ([]string, error) {
+    s.f = f
+    return s.ips, nil
+}
+
+// nopPool is a Pool ignoring its peers.
+type nopPool struct{}
+
+func (nopPool) Set(...string) {}
+
+func TestMembers(t *testing.T) {
+    src := &staticSource{ips: []string{"10.0.0.1", "10.0.0.2"}}
+    binding, err := peerbind.Bind("members", src, nopPool{}, "10.0.0.1", peerbind.PeerURL("http", 5000))
+    if err != nil {
+        t.Fatal(err)
+    }
+    allow, err := peerbind.ParseCIDRs("192.168.0.0/24, ")
+    if err != nil {
+        t.Fatal(err)
+    }
+    members := peerbind.NewMembers(func() []*peerbind.Binding { return []*peerbind.Binding{binding, nil} }, allow)
+
+    for _, tt := range []struct {
+        remoteAddr string
+        want       bool
+    }{
+        {"10.0.0.1:41234", true}, // the current pod
+        {"10.0.0.2:41234", true},
+        {"10.0.0.2", true},
+        {"10.0.0.3:41234", false},
+        {"192.168.0.7:41234", true}, // allowed by CIDR
+        {"192.168.1.7:41234", false},
+    } {
+        if got := members.Allows(tt.remoteAddr); got != tt.want {
+            t.Errorf("Allows(%q) = %v, want %v", tt.remoteAddr, got, tt.want)
+        }
+    }
+    if got := members.Rejected(); got != 2 {
+        t.Errorf("Rejected() = %d, want 2", got)
+    }
+
+    src.f("10.0.0.2", peerwatch.Removed)
+    src.f("10.0.0.3", peerwatch.Added)
+    if members.Allows("10.0.0.2:41234") || !members.Allows("10.0.0.3:41234") {
+        t.Errorf("membership did not follow the peers which left and joined")
+    }
+
+    handler := members.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+    for remoteAddr, want := range map[string]int{"10.0.0.3:41234": http.StatusOK, "10.0.0.2:41234": http.StatusForbidden} {
+        r := httptest.NewRequest("GET", "/_groupcache/group/key", nil)
+        r.RemoteAddr = remoteAddr
+        w := httptest.NewRecorder()
+        handler.ServeHTTP(w, r)
+        if w.Code != want {
+            t.Errorf("peer request from %s answered %d, want %d", remoteAddr, w.Code, want)
+        }
+    }
+}
+
+func TestParseCIDRs(t *testing.T) {
+    if _, err := peerbind.ParseCIDRs("10.0.0.0/8,not-a-cidr"); err == nil {
+        t.Errorf("ParseCIDRs accepted a bad CIDR")
+    }
+}
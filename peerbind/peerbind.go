@@ -0,0 +1,198 @@
+// Package peerbind keeps a groupcache peer pool in sync with the peers discovered by a peerwatch.Source.
+//
+// Every service using peerwatch needs the same wiring: turn peer ips into URLs, apply changes to the pool under a
+// lock (notifications arrive concurrently), make sure no change is applied before the initial peers, and know its
+// own URL. Bind does all of that.
+package peerbind
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "os"
+    "sort"
+    "sync"
+    "time"
+    "github.com/robwil/peer-aware-groupcache/peerwatch"
+)
+
+// Pool is a set of peers which can be replaced wholesale, e.g. *groupcache.HTTPPool or *ring.Pool.
+type Pool interface {
+    Set(peers ...string)
+}
+
+// PeerURL returns a function building the base URL of a peer from its ip, e.g. "http://10.0.0.2:5000".
+func PeerURL(scheme string, port int) func(ip string) string {
+    return func(ip string) string {
+        return fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(ip, fmt.Sprint(port)))
+    }
+}
+
+// SelfIP detects the ip of the current pod: MY_POD_IP (set from status.podIP with the downward API) if present,
+// otherwise the first non-loopback IPv4 address of this host.
+func SelfIP() (string, error) {
+    if ip := os.Getenv("MY_POD_IP"); ip != "" {
+        return ip, nil
+    }
+    addrs, err := net.InterfaceAddrs()
+    if err != nil {
+        return "", err
+    }
+    for _, addr := range addrs {
+        if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+            return ipNet.IP.String(), nil
+        }
+    }
+    return "", errors.New("could not detect own ip: MY_POD_IP is not set and there is no non-loopback address")
+}
+
+const (
+    minRetryDelay = 1 * time.Second
+    maxRetryDelay = 1 * time.Minute
+)
+
+// Binding keeps a Pool's peers in sync with a Source.
+type Binding struct {
+    name    string
+    pool    Pool
+    myIp    string
+    self    string
+    peerURL func(ip string) string
+    src     peerwatch.Source
+
+    mu            sync.Mutex        // guards everything below and serializes pool updates
+    urls          map[string]string // keyed by ip
+    err           error     // why the initial peers could not be discovered, while degraded
+    degradedSince time.Time // zero unless degraded
+}
+
+// Bind starts src and keeps pool's peers in sync with it until the process exits. name is only used for logging.
+//
+// If the initial peers cannot be discovered, the binding starts out degraded: the pool is set to just the
+// current pod, and the error is returned alongside the Binding. Discovery is then retried in the background,
+// with exponential backoff, until it succeeds and the pool joins the real ring.
+func Bind(name string, src peerwatch.Source, pool Pool, myIp string, peerURL func(ip string) string) (*Binding, error) {
+    b := &Binding{
+        name:    name,
+        pool:    pool,
+        myIp:    myIp,
+        self:    peerURL(myIp),
+        peerURL: peerURL,
+        src:     src,
+        urls:    make(map[string]string),
+    }
+    err := b.start(src)
+    if err != nil {
+        go b.retry(src)
+    }
+    return b, err
+}
+
+// start starts src and sets the pool to its initial peers, or to just the current pod if that fails.
+func (b *Binding) start(src peerwatch.Source) error {
+    // Hold the lock until the initial peers are set, so that no change is applied before them
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    ips, err := src.Start(b.myIp, b.notify)
+    if err != nil {
+        if b.degradedSince.IsZero() {
+            b.degradedSince = time.Now()
+        }
+        b.err = err
+        ips = []string{b.myIp}
+    } else {
+        b.err = nil
+        b.degradedSince = time.Time{}
+    }
+    b.urls = make(map[string]string, len(ips))
+    for _, ip := range ips {
+        b.urls[ip] = b.urlOf(ip)
+    }
+    urls := b.keys()
+    log.Printf("Initial peer list for %s = %v", b.name, urls)
+    b.pool.Set(urls...)
+    return err
+}
+
+func (b *Binding) retry(src peerwatch.Source) {
+    delay := minRetryDelay
+    for {
+        time.Sleep(delay)
+        err := b.start(src)
+        if err == nil {
+            log.Printf("Recovered peer discovery for %s, no longer degraded", b.name)
+            return
+        }
+        delay *= 2
+        if delay > maxRetryDelay {
+            delay = maxRetryDelay
+        }
+        log.Printf("WARNING: still running %s degraded, retrying discovery in %v: %v", b.name, delay, err)
+    }
+}
+
+func (b *Binding) notify(ip string, state peerwatch.NotifyState) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    switch state {
+    case peerwatch.Added:
+        b.urls[ip] = b.urlOf(ip)
+    case peerwatch.Removed:
+        delete(b.urls, ip)
+    default:
+        return
+    }
+    urls := b.keys()
+    log.Printf("New peer list for %s = %v", b.name, urls)
+    b.pool.Set(urls...)
+}
+
+// urlOf returns the URL of the peer with the given ip: the one reported by the source if it is a
+// peerwatch.URLSource, otherwise the one built by peerURL.
+func (b *Binding) urlOf(ip string) string {
+    if ip == b.myIp {
+        return b.self
+    }
+    if src, ok := b.src.(peerwatch.URLSource); ok {
+        if url, ok := src.PeerURL(ip); ok {
+            return url
+        }
+    }
+    return b.peerURL(ip)
+}
+
+// keys returns the sorted peer URLs. mu must be held.
+func (b *Binding) keys() []string {
+    urls := make([]string, 0, len(b.urls))
+    for _, url := range b.urls {
+        urls = append(urls, url)
+    }
+    sort.Strings(urls)
+    return urls
+}
+
+// Self returns the URL of the current pod.
+func (b *Binding) Self() string {
+    return b.self
+}
+
+// Peers returns the sorted URLs of the current peers.
+func (b *Binding) Peers() []string {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.keys()
+}
+
+// Name returns the name the binding was created with.
+func (b *Binding) Name() string {
+    return b.name
+}
+
+// Degraded reports whether peer discovery has failed so far, leaving the current pod as the only peer.
+// If so, it also returns the latest error and since when the binding has been degraded.
+func (b *Binding) Degraded() (bool, error, time.Time) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return !b.degradedSince.IsZero(), b.err, b.degradedSince
+}
@@ -0,0 +1,46 @@
+package peerbind
+
+import (
+    "encoding/json"
+    "net/http"
+    "time"
+)
+
+// Status is the state of a Binding, as served by StatusHandler.
+type Status struct {
+    Name          string     `json:"name"`
+    Self          string     `json:"self"`
+    Peers         []string   `json:"peers"`
+    Degraded      bool       `json:"degraded"`
+    Error         string     `json:"error,omitempty"`
+    DegradedSince *time.Time `json:"degradedSince,omitempty"`
+}
+
+// Status returns the current state of the binding.
+func (b *Binding) Status() Status {
+    degraded, err, since := b.Degraded()
+    status := Status{
+        Name:     b.name,
+        Self:     b.self,
+        Peers:    b.Peers(),
+        Degraded: degraded,
+    }
+    if degraded {
+        status.Error = err.Error()
+        status.DegradedSince = &since
+    }
+    return status
+}
+
+// StatusHandler serves the Status of every binding as JSON. It always responds 200 OK: a degraded binding
+// still serves requests on its own, so this is not meant as a readiness check.
+func StatusHandler(bindings func() []*Binding) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+        statuses := []Status{}
+        for _, b := range bindings() {
+            statuses = append(statuses, b.Status())
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(statuses)
+    })
+}
@@ -0,0 +1,187 @@
+// Package peertls secures the traffic between cache peers with mutual TLS.
+//
+// Every peer presents the same kind of certificate, signed by a CA shared by all peers, both when serving peer
+// requests and when making them. The certificate, key and CA are loaded from files (e.g. a mounted Kubernetes
+// Secret, as issued by cert-manager) and reloaded whenever they change, so certificates can be rotated without
+// restarting peers.
+package peertls
+
+import (
+    "bytes"
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "net/http"
+    "path/filepath"
+    "sync"
+    "time"
+)
+
+const defaultReloadInterval = 30 * time.Second
+
+// Config locates the certificates of the current peer.
+type Config struct {
+    // CertFile and KeyFile are the PEM encoded certificate (chain) and private key of the current peer.
+    CertFile string
+    KeyFile  string
+    // CAFile is the PEM encoded CA certificate(s) which peer certificates must be signed by.
+    CAFile string
+    // ServerName is the name peer certificates are verified against, as peers are addressed by ip. Defaults to
+    // verifying the peer's ip, which its certificate must then contain.
+    ServerName string
+    // ReloadInterval is how often the files are checked for changes. Defaults to 30 seconds.
+    ReloadInterval time.Duration
+}
+
+// DirConfig returns the Config of a directory holding tls.crt, tls.key and ca.crt, as mounted from a Kubernetes
+// Secret of type kubernetes.io/tls with a CA (e.g. issued by cert-manager).
+func DirConfig(dir string, serverName string) Config {
+    return Config{
+        CertFile:   filepath.Join(dir, "tls.crt"),
+        KeyFile:    filepath.Join(dir, "tls.key"),
+        CAFile:     filepath.Join(dir, "ca.crt"),
+        ServerName: serverName,
+    }
+}
+
+// Reloader holds the current certificates of a Config, reloading them when their files change. It is an
+// http.RoundTripper making requests to peers with them.
+type Reloader struct {
+    config Config
+
+    mu        sync.RWMutex // guards contents, cert, pool and transport
+    contents  []byte       // of all files as of the last load, to detect changes
+    cert      *tls.Certificate
+    pool      *x509.CertPool
+    transport *http.Transport
+}
+
+// Load loads the certificates of config, and keeps reloading them in the background whenever they change. If a
+// reload fails the previous certificates are kept.
+func Load(config Config) (*Reloader, error) {
+    if config.CertFile == "" || config.KeyFile == "" || config.CAFile == "" {
+        return nil, errors.New("peer tls requires a certificate, key and CA file")
+    }
+    if config.ReloadInterval <= 0 {
+        config.ReloadInterval = defaultReloadInterval
+    }
+    r := &Reloader{config: config}
+    if _, err := r.reload(); err != nil {
+        return nil, err
+    }
+    go r.watch()
+    return r, nil
+}
+
+func (r *Reloader) watch() {
+    ticker := time.NewTicker(r.config.ReloadInterval)
+    defer ticker.Stop()
+    for range ticker.C {
+        changed, err := r.reload()
+        if err != nil {
+            log.Printf("WARNING: error reloading peer certificates, keeping the previous ones: %v", err)
+        } else if changed {
+            log.Printf("Reloaded peer certificates")
+        }
+    }
+}
+
+// reload loads the files again if any of them changed, returning whether they did.
+func (r *Reloader) reload() (bool, error) {
+    var contents [][]byte
+    for _, file := range []string{r.config.CertFile, r.config.KeyFile, r.config.CAFile} {
+        b, err := ioutil.ReadFile(file)
+        if err != nil {
+            return false, err
+        }
+        contents = append(contents, b)
+    }
+    all := bytes.Join(contents, nil)
+    r.mu.RLock()
+    unchanged := bytes.Equal(all, r.contents)
+    r.mu.RUnlock()
+    if unchanged {
+        return false, nil
+    }
+
+    cert, err := tls.X509KeyPair(contents[0], contents[1])
+    if err != nil {
+        return false, fmt.Errorf("loading certificate: %v", err)
+    }
+    pool := x509.NewCertPool()
+    if !pool.AppendCertsFromPEM(contents[2]) {
+        return false, fmt.Errorf("no CA certificates found in %s", r.config.CAFile)
+    }
+
+    r.mu.Lock()
+    previous := r.transport
+    r.contents, r.cert, r.pool = all, &cert, pool
+    r.transport = &http.Transport{
+        Proxy:               http.ProxyFromEnvironment,
+        TLSClientConfig:     r.clientConfig(pool),
+        MaxIdleConnsPerHost: 10,
+        IdleConnTimeout:     90 * time.Second,
+        TLSHandshakeTimeout: 10 * time.Second,
+    }
+    r.mu.Unlock()
+    if previous != nil {
+        previous.CloseIdleConnections()
+    }
+    return true, nil
+}
+
+func (r *Reloader) clientConfig(pool *x509.CertPool) *tls.Config {
+    return &tls.Config{
+        RootCAs:    pool,
+        ServerName: r.config.ServerName,
+        GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+            r.mu.RLock()
+            defer r.mu.RUnlock()
+            return r.cert, nil
+        },
+        MinVersion: tls.VersionTLS12,
+    }
+}
+
+// RoundTrip makes a request to a peer, presenting the current certificate and verifying the peer's against the
+// current CA.
+func (r *Reloader) RoundTrip(req *http.Request) (*http.Response, error) {
+    r.mu.RLock()
+    transport := r.transport
+    r.mu.RUnlock()
+    return transport.RoundTrip(req)
+}
+
+// ServerConfig returns the TLS configuration of an http.Server serving peers. Client certificates are verified
+// against the current CA when presented but not required, so that endpoints other than the peer protocol (e.g.
+// health checks by the kubelet) keep working: wrap the peer handler with RequireClientCert.
+func (r *Reloader) ServerConfig() *tls.Config {
+    return &tls.Config{
+        MinVersion: tls.VersionTLS12,
+        GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+            r.mu.RLock()
+            defer r.mu.RUnlock()
+            return &tls.Config{
+                Certificates: []tls.Certificate{*r.cert},
+                ClientCAs:    r.pool,
+                ClientAuth:   tls.VerifyClientCertIfGiven,
+                MinVersion:   tls.VersionTLS12,
+            }, nil
+        },
+    }
+}
+
+// RequireClientCert only lets requests through to handler which presented a client certificate signed by the
+// peers' CA, answering 403 otherwise.
+func RequireClientCert(handler http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+            http.Error(w, "peer certificate required", http.StatusForbidden)
+            return
+        }
+        handler.ServeHTTP(w, r)
+    })
+}
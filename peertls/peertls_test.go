@@ -0,0 +1,191 @@
+package peertls_test
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/pem"
+    "io/ioutil"
+    "math/big"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strconv"
+    "testing"
+    "time"
+    "github.com/robwil/peer-aware-groupcache/groupcache"
+    "github.com/robwil/peer-aware-groupcache/peertls"
+    "github.com/robwil/peer-aware-groupcache/ring"
+    pb "github.com/golang/groupcache/groupcachepb"
+)
+
+// serverName is the name every node certificate is issued for, as peers are addressed by ip.
+const serverName = "peer"
+
+// testCA is a CA issuing node certificates.
+type testCA struct {
+    cert *x509.Certificate
+    key  *ecdsa.PrivateKey
+    pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    template := &x509.Certificate{
+        SerialNumber:          big.NewInt(1),
+        Subject:               pkix.Name{CommonName: "peer test CA"},
+        NotBefore:             time.Now().Add(-time.Hour),
+        NotAfter:              time.Now().Add(time.Hour),
+        KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+        BasicConstraintsValid: true,
+        IsCA:                  true,
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    cert, err := x509.ParseCertificate(der)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns the PEM encoded certificate and key of a node, for both serving and making peer requests.
+func (ca *testCA) issue(t *testing.T, serial int64) ([]byte, []byte) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    template := &x509.Certificate{
+        SerialNumber: big.NewInt(serial),
+        Subject:      pkix.Name{CommonName: serverName},
+        DNSNames:     []string{serverName},
+        IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+        NotBefore:    time.Now().Add(-time.Hour),
+        NotAfter:     time.Now().Add(time.Hour),
+        KeyUsage:     x509.KeyUsageDigitalSignature,
+        ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    keyDer, err := x509.MarshalECPrivateKey(key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+// loadNode writes the certificates of a node into a directory laid out like a mounted Secret, and loads them.
+func loadNode(t *testing.T, ca *testCA, serial int64) *peertls.Reloader {
+    dir, err := ioutil.TempDir("", "peertls")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { os.RemoveAll(dir) })
+    cert, key := ca.issue(t, serial)
+    files := map[string][]byte{"tls.crt": cert, "tls.key": key, "ca.crt": ca.pem}
+    for name, contents := range files {
+        if err := ioutil.WriteFile(filepath.Join(dir, name), contents, 0600); err != nil {
+            t.Fatal(err)
+        }
+    }
+    reloader, err := peertls.Load(peertls.DirConfig(dir, serverName))
+    if err != nil {
+        t.Fatal(err)
+    }
+    return reloader
+}
+
+// startNode serves peer requests over TLS with the certificates of reloader, only to peers presenting theirs.
+func startNode(t *testing.T, reloader *peertls.Reloader) *httptest.Server {
+    server := httptest.NewUnstartedServer(peertls.RequireClientCert(&ring.Handler{}))
+    server.TLS = reloader.ServerConfig()
+    server.StartTLS()
+    t.Cleanup(server.Close)
+    return server
+}
+
+func TestCluster(t *testing.T) {
+    // the group loads every key locally: requests from the pool below go to whichever node owns the key
+    groupcache.NewGroup("peertls-test", 1<<20, groupcache.GetterFunc(func(_ groupcache.Context, key string, dest groupcache.Sink) error {
+        return dest.SetString("value of " + key)
+    }))
+
+    ca := newTestCA(t)
+    nodes := []*peertls.Reloader{loadNode(t, ca, 2), loadNode(t, ca, 3)}
+    servers := []*httptest.Server{startNode(t, nodes[0]), startNode(t, nodes[1])}
+
+    pool := ring.NewPool(servers[0].URL, &ring.Options{
+        Transport: func(groupcache.Context) http.RoundTripper { return nodes[0] },
+    })
+    pool.Set(servers[0].URL, servers[1].URL)
+
+    t.Run("peers get values", func(t *testing.T) {
+        got := 0
+        for i := 0; got == 0 && i < 100; i++ {
+            key := strconv.Itoa(i)
+            peer, ok := pool.PickPeer(key)
+            if !ok {
+                continue // owned by the first node
+            }
+            group := "peertls-test"
+            res := &pb.GetResponse{}
+            if err := peer.Get(nil, &pb.GetRequest{Group: &group, Key: &key}, res); err != nil {
+                t.Fatalf("getting %s from %s: %v", key, pool.Owner(key), err)
+            }
+            if want := "value of " + key; string(res.Value) != want {
+                t.Errorf("got %q, want %q", res.Value, want)
+            }
+            got++
+        }
+        if got == 0 {
+            t.Fatal("no key owned by the second node")
+        }
+    })
+
+    url := servers[1].URL + ring.DefaultBasePath + "peertls-test/k"
+    caPool := x509.NewCertPool()
+    caPool.AddCert(ca.cert)
+
+    t.Run("clients without a certificate are rejected", func(t *testing.T) {
+        client := &http.Client{Transport: &http.Transport{
+            TLSClientConfig: &tls.Config{RootCAs: caPool, ServerName: serverName},
+        }}
+        res, err := client.Get(url)
+        if err != nil {
+            t.Fatal(err)
+        }
+        res.Body.Close()
+        if res.StatusCode != http.StatusForbidden {
+            t.Errorf("got %v, want 403", res.Status)
+        }
+    })
+
+    t.Run("clients with an untrusted certificate are rejected", func(t *testing.T) {
+        other := newTestCA(t)
+        certPEM, keyPEM := other.issue(t, 2)
+        cert, err := tls.X509KeyPair(certPEM, keyPEM)
+        if err != nil {
+            t.Fatal(err)
+        }
+        client := &http.Client{Transport: &http.Transport{
+            TLSClientConfig: &tls.Config{RootCAs: caPool, ServerName: serverName, Certificates: []tls.Certificate{cert}},
+        }}
+        res, err := client.Get(url)
+        if err == nil {
+            res.Body.Close()
+            t.Errorf("got %v, want the handshake to fail", res.Status)
+        }
+    })
+}
@@ -0,0 +1,202 @@
+package peerwatch
+
+import (
+    "errors"
+    "sort"
+    "sync"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/client-go/kubernetes"
+    "k8s.io/client-go/tools/clientcmd"
+)
+
+// Cluster is a named Kubernetes API in which peers are discovered.
+type Cluster struct {
+    Name   string
+    Client kubernetes.Interface
+}
+
+// NewClusterFromKubeconfig creates a Cluster using the given context of a kubeconfig file.
+// An empty context uses the kubeconfig's current context.
+func NewClusterFromKubeconfig(name string, kubeconfigPath string, context string) (Cluster, error) {
+    config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+        &clientcmd.ClientConfigLoadingRules{ExplicitPath: kubeconfigPath},
+        &clientcmd.ConfigOverrides{CurrentContext: context},
+    ).ClientConfig()
+    if err != nil {
+        return Cluster{}, err
+    }
+    client, err := kubernetes.NewForConfig(config)
+    if err != nil {
+        return Cluster{}, err
+    }
+    return Cluster{Name: name, Client: client}, nil
+}
+
+// Peer is a discovered peer, tagged with the cluster it was discovered in.
+// The current pod is always reported with an empty Cluster.
+type Peer struct {
+    IP      string
+    Cluster string
+}
+
+type PeerNotifyFunc func(peer Peer, state NotifyState)
+
+// peerMerger merges the pod sets of several clusters into one de-duplicated peer set.
+// A peer is Added when the first cluster reports it and Removed once no cluster reports it any more. f is called
+// with the merger locked, so that changes reach it in the order they happened.
+type peerMerger struct {
+    mu      sync.Mutex
+    myIp    string
+    sources map[string]map[string]bool // peer ip -> names of the clusters reporting it
+    f       PeerNotifyFunc
+}
+
+func newPeerMerger(myIp string, f PeerNotifyFunc) *peerMerger {
+    return &peerMerger{
+        myIp:    myIp,
+        sources: make(map[string]map[string]bool),
+        f:       f,
+    }
+}
+
+// notifierFor returns the NotifyFunc which the pod monitor of the named cluster reports its changes to.
+func (m *peerMerger) notifierFor(cluster string) NotifyFunc {
+    return func(ip string, state NotifyState) {
+        if ip == m.myIp {
+            return
+        }
+        m.mu.Lock()
+        defer m.mu.Unlock()
+        clusters := m.sources[ip]
+        switch state {
+        case Added:
+            if clusters == nil {
+                clusters = make(map[string]bool)
+                m.sources[ip] = clusters
+                debugLogf("Peer %s joined from cluster %s", ip, cluster)
+                m.f(Peer{IP: ip, Cluster: cluster}, Added)
+            }
+            clusters[cluster] = true
+        case Removed:
+            if !clusters[cluster] {
+                return
+            }
+            delete(clusters, cluster)
+            if len(clusters) == 0 {
+                delete(m.sources, ip)
+                debugLogf("Peer %s left from cluster %s", ip, cluster)
+                m.f(Peer{IP: ip, Cluster: cluster}, Removed)
+            }
+        }
+    }
+}
+
+// seed records the initial pods of a cluster without notifying.
+func (m *peerMerger) seed(cluster string, pods podSet) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    for ip := range pods {
+        if ip == m.myIp {
+            continue
+        }
+        if m.sources[ip] == nil {
+            m.sources[ip] = make(map[string]bool)
+        }
+        m.sources[ip][cluster] = true
+    }
+}
+
+// peers returns the merged peer set, sorted by ip. A peer reported by several clusters is tagged with the
+// first of them by name.
+func (m *peerMerger) peers() []Peer {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    peers := []Peer{{IP: m.myIp}}
+    for ip, clusters := range m.sources {
+        names := make([]string, 0, len(clusters))
+        for name := range clusters {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        peers = append(peers, Peer{IP: ip, Cluster: names[0]})
+    }
+    sort.Slice(peers, func(i, j int) bool { return peers[i].IP < peers[j].IP })
+    return peers
+}
+
+// MultiClusterSource is a Source of the peers of several clusters (e.g. with flat pod networking between them),
+// merged into a single de-duplicated peer set.
+//
+// A cluster whose API is unavailable does not prevent the others from being used: it is retried in the
+// background, and its peers are notified as Added once it becomes reachable. The peers of a cluster whose API
+// becomes unavailable later on are kept until it can be listed again. Start only fails when no cluster could be
+// listed at all.
+type MultiClusterSource struct {
+    Clusters    []Cluster
+    ListOptions metav1.ListOptions
+    // OnPeer is optionally notified of the peers along with the cluster each one was discovered in, which Start's
+    // NotifyFunc does not carry: first every initial peer other than the current pod as Added, then every change,
+    // right before the NotifyFunc.
+    OnPeer PeerNotifyFunc
+}
+
+func (s MultiClusterSource) Start(myIp string, f NotifyFunc) ([]string, error) {
+    peers, watch, err := startMulti(myIp, s.Clusters, s.ListOptions, func(peer Peer, state NotifyState) {
+        if s.OnPeer != nil {
+            s.OnPeer(peer, state)
+        }
+        f(peer.IP, state)
+    })
+    if err != nil {
+        return nil, err
+    }
+    ips := make([]string, len(peers))
+    for i, peer := range peers {
+        ips[i] = peer.IP
+        if s.OnPeer != nil && peer.IP != myIp {
+            s.OnPeer(peer, Added)
+        }
+    }
+    watch()
+    return ips, nil
+}
+
+// startMulti lists the pods of every cluster, and returns the merged initial peers along with watch, which starts
+// notifying f of their changes.
+func startMulti(myIp string, clusters []Cluster, listOptions metav1.ListOptions, f PeerNotifyFunc) ([]Peer, func(), error) {
+    if len(clusters) == 0 {
+        return nil, nil, errors.New("no clusters to discover peers in")
+    }
+
+    merger := newPeerMerger(myIp, f)
+    initialPods := make([]podSet, len(clusters))
+    resourceVersions := make([]string, len(clusters))
+    available := 0
+    for i, cluster := range clusters {
+        pods, resourceVersion, err := getInitialPods(cluster.Client, listOptions, myIp, false)
+        if err != nil {
+            debugLogf("WARNING: could not get initial pod list of cluster %s: %v", cluster.Name, err)
+            continue
+        }
+        available++
+        initialPods[i], resourceVersions[i] = pods, resourceVersion
+        merger.seed(cluster.Name, pods)
+    }
+    if available == 0 {
+        // nothing monitors the clusters yet, so that retrying (see peerbind.Bind) does not leak any monitor
+        return nil, nil, errors.New("could not get initial pod list of any cluster")
+    }
+
+    watch := func() {
+        for i, cluster := range clusters {
+            pods := initialPods[i]
+            if pods == nil {
+                // listed again in the background until the cluster's API is available
+                debugLogf("Will keep retrying to list the pods of cluster %s", cluster.Name)
+                pods = make(podSet)
+            }
+            go monitorPodState(cluster.Client, listOptions, myIp, pods, resourceVersions[i], merger.notifierFor(cluster.Name))
+        }
+    }
+    return merger.peers(), watch, nil
+}
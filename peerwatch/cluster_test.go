@@ -0,0 +1,44 @@
+package peerwatch
+
+import (
+    "reflect"
+    "testing"
+)
+
+// event is a change a peerMerger reported.
+type event struct {
+    peer  Peer
+    state NotifyState
+}
+
+func TestPeerMerger(t *testing.T) {
+    var events []event
+    m := newPeerMerger("10.0.0.1", func(peer Peer, state NotifyState) {
+        events = append(events, event{peer, state})
+    })
+    m.seed("a", podSet{"10.0.0.1": true, "10.0.0.2": true})
+    m.seed("b", podSet{"10.0.0.2": true})
+    if got, want := m.peers(), []Peer{{IP: "10.0.0.1"}, {IP: "10.0.0.2", Cluster: "a"}}; !reflect.DeepEqual(got, want) {
+        t.Fatalf("initial peers = %v, want %v", got, want)
+    }
+
+    a, b := m.notifierFor("a"), m.notifierFor("b")
+    a("10.0.0.1", Added)   // the current pod is never notified
+    a("10.0.0.2", Removed) // still reported by b
+    b("10.0.0.3", Added)
+    b("10.0.0.2", Removed)
+    b("10.0.0.3", Removed)
+    b("10.0.0.3", Added)
+    want := []event{
+        {Peer{IP: "10.0.0.3", Cluster: "b"}, Added},
+        {Peer{IP: "10.0.0.2", Cluster: "b"}, Removed},
+        {Peer{IP: "10.0.0.3", Cluster: "b"}, Removed},
+        {Peer{IP: "10.0.0.3", Cluster: "b"}, Added},
+    }
+    if !reflect.DeepEqual(events, want) {
+        t.Errorf("events = %v, want %v in that order", events, want)
+    }
+    if got, want := m.peers(), []Peer{{IP: "10.0.0.1"}, {IP: "10.0.0.3", Cluster: "b"}}; !reflect.DeepEqual(got, want) {
+        t.Errorf("peers = %v, want %v", got, want)
+    }
+}
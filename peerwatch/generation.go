@@ -0,0 +1,197 @@
+package peerwatch
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+    "k8s.io/api/core/v1"
+    apierrors "k8s.io/apimachinery/pkg/api/errors"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/apimachinery/pkg/fields"
+    "k8s.io/apimachinery/pkg/watch"
+    "k8s.io/client-go/kubernetes"
+)
+
+const maxGenerationConflicts = 5
+
+// GenerationNotifyFunc is called with the epoch of a ConfigMap and the generation of every group stored in it, keyed
+// by group name, whenever any of them changes. Groups missing from it are at generation 0. The epoch tells apart
+// ConfigMaps of the same name which were deleted and created again (see ConfigMapEpoch), and is "" while there is no
+// ConfigMap.
+type GenerationNotifyFunc func(epoch string, generations map[string]int64)
+
+// ConfigMapEpoch returns the epoch of the generations stored in configMap: the start of its UID, which changes
+// whenever the ConfigMap is created again.
+func ConfigMapEpoch(configMap *v1.ConfigMap) string {
+    uid := string(configMap.UID)
+    if i := strings.IndexByte(uid, '-'); i >= 0 {
+        return uid[:i]
+    }
+    return uid
+}
+
+// WatchGenerations calls f with the generations stored in the named ConfigMap (see BumpGeneration), and then keeps
+// notifying f of changes to them from a goroutine. Watching requires permission to list and watch ConfigMaps.
+//
+// If the ConfigMap cannot be read at first, the error is returned and it is read again in the background, with
+// backoff, until f can be called with its generations.
+func WatchGenerations(configMapName string, f GenerationNotifyFunc) error {
+    kubeClient, err := newInClusterClient()
+    if err != nil {
+        return err
+    }
+    listOptions := metav1.ListOptions{FieldSelector: fields.OneTermEqualSelector("metadata.name", configMapName).String()}
+    var currentEpoch string
+    var current map[string]int64
+    changed := func(epoch string, generations map[string]int64) {
+        if current != nil && epoch == currentEpoch && equalGenerations(current, generations) {
+            return
+        }
+        currentEpoch, current = epoch, generations
+        f(epoch, generations)
+    }
+    epoch, generations, resourceVersion, err := listGenerations(kubeClient, listOptions)
+    if err == nil {
+        changed(epoch, generations)
+    }
+    go monitorGenerations(kubeClient, listOptions, resourceVersion, changed)
+    return err
+}
+
+// listGenerations reads the epoch and generations of the ConfigMap matching listOptions, if it exists, returning
+// them along with the resourceVersion of the list.
+func listGenerations(clientset kubernetes.Interface, listOptions metav1.ListOptions) (string, map[string]int64, string, error) {
+    configMaps, err := clientset.CoreV1().ConfigMaps(namespace).List(listOptions)
+    if err != nil {
+        return "", nil, "", err
+    }
+    epoch, generations := "", make(map[string]int64)
+    for _, configMap := range configMaps.Items {
+        epoch, generations = ConfigMapEpoch(&configMap), parseGenerations(&configMap)
+    }
+    return epoch, generations, configMaps.ResourceVersion, nil
+}
+
+// monitorGenerations keeps calling changed with the generations of the ConfigMap matching listOptions forever. Like
+// monitorPods, it lists the ConfigMap again whenever a watch ends; an empty resourceVersion forces that list to
+// happen first.
+func monitorGenerations(clientset kubernetes.Interface, listOptions metav1.ListOptions, resourceVersion string, changed GenerationNotifyFunc) {
+    retryDelay := minRetryDelay
+    for {
+        if resourceVersion == "" {
+            epoch, generations, listResourceVersion, err := listGenerations(clientset, listOptions)
+            if err != nil {
+                debugLogf("WARNING: error reading generations, retrying in %v: %v", retryDelay, err)
+                time.Sleep(retryDelay)
+                retryDelay = nextRetryDelay(retryDelay)
+                continue
+            }
+            changed(epoch, generations)
+            resourceVersion = listResourceVersion
+        }
+
+        watchOptions := listOptions
+        watchOptions.ResourceVersion = resourceVersion
+        watchInterface, err := clientset.CoreV1().ConfigMaps(namespace).Watch(watchOptions)
+        if err != nil {
+            debugLogf("WARNING: error watching generations, retrying in %v: %v", retryDelay, err)
+            time.Sleep(retryDelay)
+            retryDelay = nextRetryDelay(retryDelay)
+            resourceVersion = ""
+            continue
+        }
+        retryDelay = minRetryDelay
+
+        for event := range watchInterface.ResultChan() {
+            if event.Type == watch.Error {
+                debugLogf("WARNING: got error from generation watching: %v", event.Object)
+                break
+            }
+            configMap, ok := event.Object.(*v1.ConfigMap)
+            if !ok {
+                continue
+            }
+            if event.Type == watch.Deleted {
+                changed("", make(map[string]int64))
+            } else {
+                changed(ConfigMapEpoch(configMap), parseGenerations(configMap))
+            }
+        }
+        watchInterface.Stop()
+        resourceVersion = ""
+    }
+}
+
+// parseGenerations returns the generations stored in configMap, skipping any which are not numbers.
+func parseGenerations(configMap *v1.ConfigMap) map[string]int64 {
+    generations := make(map[string]int64, len(configMap.Data))
+    for groupName, value := range configMap.Data {
+        generation, err := strconv.ParseInt(value, 10, 64)
+        if err != nil {
+            debugLogf("WARNING: bad generation %q of group %s in configmap %s", value, groupName, configMap.Name)
+            continue
+        }
+        generations[groupName] = generation
+    }
+    return generations
+}
+
+func equalGenerations(a map[string]int64, b map[string]int64) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for groupName, generation := range a {
+        if other, ok := b[groupName]; !ok || other != generation {
+            return false
+        }
+    }
+    return true
+}
+
+// BumpGeneration increments the generation of the named group in the named ConfigMap, creating the ConfigMap if
+// missing, and returns the epoch of the ConfigMap along with the new generation. As with heartbeats, the update carries the resourceVersion read just
+// before it, so that concurrent bumps conflict and are retried rather than lost. Bumping requires permission to get,
+// create and update the ConfigMap.
+func BumpGeneration(configMapName string, groupName string) (string, int64, error) {
+    kubeClient, err := newInClusterClient()
+    if err != nil {
+        return "", 0, err
+    }
+    configMaps := kubeClient.CoreV1().ConfigMaps(namespace)
+    for attempt := 0; attempt < maxGenerationConflicts; attempt++ {
+        configMap, err := configMaps.Get(configMapName, metav1.GetOptions{})
+        if apierrors.IsNotFound(err) {
+            configMap = &v1.ConfigMap{
+                ObjectMeta: metav1.ObjectMeta{Name: configMapName},
+                Data:       map[string]string{groupName: "1"},
+            }
+            created, err := configMaps.Create(configMap)
+            if err != nil {
+                if apierrors.IsAlreadyExists(err) {
+                    continue
+                }
+                return "", 0, err
+            }
+            return ConfigMapEpoch(created), 1, nil
+        }
+        if err != nil {
+            return "", 0, err
+        }
+
+        generation := parseGenerations(configMap)[groupName] + 1
+        if configMap.Data == nil {
+            configMap.Data = make(map[string]string)
+        }
+        configMap.Data[groupName] = strconv.FormatInt(generation, 10)
+        if _, err := configMaps.Update(configMap); err != nil {
+            if apierrors.IsConflict(err) {
+                debugLogf("Conflict bumping generation of %s in configmap %s, retrying", groupName, configMapName)
+                continue
+            }
+            return "", 0, err
+        }
+        return ConfigMapEpoch(configMap), generation, nil
+    }
+    return "", 0, fmt.Errorf("gave up bumping generation of %s after %d conflicts", groupName, maxGenerationConflicts)
+}
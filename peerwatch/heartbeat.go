@@ -0,0 +1,316 @@
+package peerwatch
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "math/rand"
+    "sync"
+    "time"
+    "k8s.io/api/core/v1"
+    apierrors "k8s.io/apimachinery/pkg/api/errors"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/client-go/kubernetes"
+)
+
+const (
+    defaultHeartbeatInterval = 5 * time.Second
+    maxHeartbeatConflicts    = 8
+    heartbeatConflictBackoff = 50 * time.Millisecond
+)
+
+// HeartbeatOptions configures ConfigMap heartbeat membership.
+type HeartbeatOptions struct {
+    // ConfigMapName is the name of the ConfigMap shared by all instances. It is created if missing.
+    ConfigMapName string
+    // Interval is how often this instance writes its heartbeat, give or take a tenth so that instances do not all
+    // write at once. Defaults to 5 seconds.
+    Interval time.Duration
+    // TTL is how long a heartbeat stays valid. Peers whose heartbeat has not changed for longer are removed.
+    // Defaults to 3 * Interval.
+    TTL time.Duration
+    // PeerURL builds the base URL a pod serves peer requests on from its ip, which this instance's heartbeat
+    // records. It is required.
+    PeerURL func(ip string) string
+}
+
+func (opts *HeartbeatOptions) setDefaults() {
+    if opts.Interval <= 0 {
+        opts.Interval = defaultHeartbeatInterval
+    }
+    if opts.TTL <= 0 {
+        opts.TTL = 3 * opts.Interval
+    }
+}
+
+// heartbeat is the entry of a peer in the shared ConfigMap. Entries are keyed by the peer's ip, as ConfigMap keys
+// cannot hold URLs, and carry the peer's base URL, which HeartbeatSource reports as the peer's URL (see URLSource).
+type heartbeat struct {
+    URL       string    `json:"url"`
+    Timestamp time.Time `json:"timestamp"`
+}
+
+func (h heartbeat) encode() string {
+    b, _ := json.Marshal(h)
+    return string(b)
+}
+
+// parseHeartbeat decodes the entry of a peer, which may still be a bare timestamp if written by an older version.
+func parseHeartbeat(value string) (heartbeat, error) {
+    var h heartbeat
+    if err := json.Unmarshal([]byte(value), &h); err == nil {
+        return h, nil
+    }
+    t, err := time.Parse(time.RFC3339Nano, value)
+    if err != nil {
+        return heartbeat{}, err
+    }
+    return heartbeat{Timestamp: t}, nil
+}
+
+// observation is when the current instance last saw the heartbeat of a peer change.
+type observation struct {
+    timestamp time.Time // as written by the peer, by its own clock
+    at        time.Time // by the current instance's clock
+}
+
+// HeartbeatSource is a Source of peers for namespaces where listing pods is forbidden. Instead of watching pods,
+// each instance periodically writes a heartbeat entry into the ConfigMap named by Options.ConfigMapName, and peers
+// whose heartbeat has expired are removed. Only get, create and update on that ConfigMap are required.
+//
+// Heartbeats are only ever compared with earlier heartbeats of the same peer: a peer is live while its heartbeat
+// keeps changing, as seen by the current instance's own clock, so clock skew between nodes does not matter.
+//
+// A HeartbeatSource must not be copied once started, and Leave removes the current instance's heartbeat when it
+// shuts down.
+type HeartbeatSource struct {
+    Options HeartbeatOptions
+
+    mu     sync.Mutex // guards everything below, and serializes writes to the ConfigMap
+    opts   HeartbeatOptions
+    client kubernetes.Interface
+    myIp   string
+    seen   map[string]observation // keyed by peer ip
+    urls   map[string]string      // base URL of the peers, keyed by ip
+    rand   *rand.Rand             // seeded per instance, so that instances do not all back off alike
+    left   bool
+}
+
+func (s *HeartbeatSource) Start(myIp string, f NotifyFunc) ([]string, error) {
+    opts := s.Options
+    if opts.ConfigMapName == "" {
+        return nil, errors.New("heartbeat membership requires a ConfigMapName")
+    }
+    if opts.PeerURL == nil {
+        return nil, errors.New("heartbeat membership requires a PeerURL")
+    }
+    opts.setDefaults()
+
+    kubeClient, err := newInClusterClient()
+    if err != nil {
+        return nil, err
+    }
+
+    s.mu.Lock()
+    s.opts, s.client, s.myIp = opts, kubeClient, myIp
+    s.seen = make(map[string]observation)
+    s.urls = make(map[string]string)
+    s.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+    s.mu.Unlock()
+
+    initialPeers, err := s.writeHeartbeat()
+    if err != nil {
+        return nil, fmt.Errorf("could not write initial heartbeat: %v", err)
+    }
+    peerIps := initialPeers.Keys()
+
+    go s.monitor(initialPeers, f)
+
+    return peerIps, nil
+}
+
+// PeerURL implements URLSource: it returns the base URL which the peer with the given ip wrote in its heartbeat.
+func (s *HeartbeatSource) PeerURL(ip string) (string, bool) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    url, ok := s.urls[ip]
+    return url, ok
+}
+
+// Leave stops writing heartbeats and removes the current instance's one, for peers to drop it right away rather
+// than once it expires. It is meant for shutting down, and the source does not notify of any change afterwards.
+func (s *HeartbeatSource) Leave() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.left || s.client == nil {
+        s.left = true
+        return nil
+    }
+    s.left = true
+
+    configMaps := s.client.CoreV1().ConfigMaps(namespace)
+    for attempt := 0; attempt < maxHeartbeatConflicts; attempt++ {
+        configMap, err := configMaps.Get(s.opts.ConfigMapName, metav1.GetOptions{})
+        if apierrors.IsNotFound(err) {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        if _, ok := configMap.Data[s.myIp]; !ok {
+            return nil
+        }
+        delete(configMap.Data, s.myIp)
+        if _, err := configMaps.Update(configMap); err != nil {
+            if apierrors.IsConflict(err) {
+                time.Sleep(s.conflictBackoff(attempt))
+                continue
+            }
+            return err
+        }
+        return nil
+    }
+    return fmt.Errorf("gave up removing heartbeat after %d conflicts", maxHeartbeatConflicts)
+}
+
+// conflictBackoff is how long to wait before retrying a write which conflicted with another instance's: a random
+// share of an exponentially growing delay, so that instances which conflicted once do not conflict again.
+// mu must be held.
+func (s *HeartbeatSource) conflictBackoff(attempt int) time.Duration {
+    return time.Duration(s.rand.Int63n(int64(heartbeatConflictBackoff << uint(attempt))))
+}
+
+// writeHeartbeat records myIp with its base URL and the current time in the shared ConfigMap, pruning any expired
+// entries along the way. The update carries the resourceVersion read just before it, so concurrent writers conflict
+// instead of overwriting each other; on conflict the read-modify-write is retried after a jittered backoff.
+// It returns the set of ips whose heartbeat is still valid, including myIp, and nothing once the source has left.
+func (s *HeartbeatSource) writeHeartbeat() (podSet, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.left {
+        return nil, errors.New("left the heartbeat ConfigMap")
+    }
+    configMaps := s.client.CoreV1().ConfigMaps(namespace)
+    for attempt := 0; attempt < maxHeartbeatConflicts; attempt++ {
+        if attempt > 0 {
+            time.Sleep(s.conflictBackoff(attempt - 1))
+        }
+        now := time.Now()
+        mine := heartbeat{URL: s.opts.PeerURL(s.myIp), Timestamp: now}.encode()
+        configMap, err := configMaps.Get(s.opts.ConfigMapName, metav1.GetOptions{})
+        if apierrors.IsNotFound(err) {
+            configMap = &v1.ConfigMap{
+                ObjectMeta: metav1.ObjectMeta{Name: s.opts.ConfigMapName},
+                Data:       map[string]string{s.myIp: mine},
+            }
+            if _, err := configMaps.Create(configMap); err != nil {
+                if apierrors.IsAlreadyExists(err) {
+                    continue
+                }
+                return nil, err
+            }
+            return s.observe(configMap.Data, now), nil
+        }
+        if err != nil {
+            return nil, err
+        }
+
+        live := s.observe(configMap.Data, now)
+        data := make(map[string]string, len(live)+1)
+        for ip := range live {
+            data[ip] = configMap.Data[ip]
+        }
+        data[s.myIp] = mine
+        configMap.Data = data
+
+        if _, err := configMaps.Update(configMap); err != nil {
+            if apierrors.IsConflict(err) {
+                debugLogf("Conflict writing heartbeat to configmap %s, retrying", s.opts.ConfigMapName)
+                continue
+            }
+            return nil, err
+        }
+        live[s.myIp] = true
+        return live, nil
+    }
+    return nil, fmt.Errorf("gave up writing heartbeat after %d conflicts", maxHeartbeatConflicts)
+}
+
+// observe records the heartbeats of data as seen at now, and returns the ips of the live ones. The current instance's
+// own heartbeat is always live. mu must be held.
+func (s *HeartbeatSource) observe(data map[string]string, now time.Time) podSet {
+    live := make(podSet)
+    seen := make(map[string]observation, len(data))
+    for ip, value := range data {
+        if ip == s.myIp {
+            live[ip] = true
+            continue
+        }
+        h, err := parseHeartbeat(value)
+        if err != nil {
+            continue
+        }
+        o, ok := s.seen[ip]
+        if !ok || !o.timestamp.Equal(h.Timestamp) {
+            // a heartbeat seen for the first time counts as fresh, as its timestamp is only comparable with the
+            // peer's later ones
+            o = observation{timestamp: h.Timestamp, at: now}
+        }
+        seen[ip] = o
+        if now.Sub(o.at) <= s.opts.TTL {
+            live[ip] = true
+            if h.URL != "" {
+                s.urls[ip] = h.URL
+            }
+        }
+    }
+    s.seen = seen
+    for ip := range s.urls {
+        if !live[ip] {
+            delete(s.urls, ip)
+        }
+    }
+    return live
+}
+
+// nextInterval returns how long to wait before writing the next heartbeat: Interval give or take a tenth.
+func (s *HeartbeatSource) nextInterval() time.Duration {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    d := s.opts.Interval
+    return d - d/10 + time.Duration(s.rand.Int63n(int64(d/5)+1))
+}
+
+func (s *HeartbeatSource) monitor(initialPeers podSet, f NotifyFunc) {
+    peerSet := initialPeers
+    debugLogf("Initial heartbeat peer list = %v", peerSet)
+
+    for {
+        time.Sleep(s.nextInterval())
+        live, err := s.writeHeartbeat()
+        s.mu.Lock()
+        left := s.left
+        s.mu.Unlock()
+        if left {
+            return
+        }
+        if err != nil {
+            debugLogf("WARNING: error writing heartbeat: %v", err)
+            continue
+        }
+        for ip := range live {
+            if ip != s.myIp && !peerSet[ip] {
+                debugLogf("Newly heartbeating peer %s", ip)
+                peerSet[ip] = true
+                f(ip, Added)
+            }
+        }
+        for ip := range peerSet {
+            if ip != s.myIp && !live[ip] {
+                debugLogf("Expired heartbeat for peer %s", ip)
+                delete(peerSet, ip)
+                f(ip, Removed)
+            }
+        }
+    }
+}
@@ -0,0 +1,46 @@
+package peerwatch
+
+import (
+    "reflect"
+    "testing"
+    "time"
+)
+
+func TestHeartbeatLiveness(t *testing.T) {
+    s := &HeartbeatSource{
+        opts: HeartbeatOptions{TTL: 15 * time.Second},
+        myIp: "10.0.0.1",
+        seen: make(map[string]observation),
+        urls: make(map[string]string),
+    }
+    start := time.Now()
+    // the clock of 10.0.0.2 is an hour behind, the one of 10.0.0.3 an hour ahead
+    behind, ahead := start.Add(-time.Hour), start.Add(time.Hour)
+    data := func(behind, ahead time.Time) map[string]string {
+        return map[string]string{
+            "10.0.0.1": "garbage", // the current pod's own heartbeat is always live
+            "10.0.0.2": heartbeat{URL: "https://10.0.0.2:5000", Timestamp: behind}.encode(),
+            "10.0.0.3": heartbeat{URL: "https://10.0.0.3:5000", Timestamp: ahead}.encode(),
+        }
+    }
+
+    if got, want := s.observe(data(behind, ahead), start), (podSet{"10.0.0.1": true, "10.0.0.2": true, "10.0.0.3": true}); !reflect.DeepEqual(got, want) {
+        t.Fatalf("live peers = %v, want %v regardless of clock skew", got, want)
+    }
+    if url, ok := s.PeerURL("10.0.0.2"); !ok || url != "https://10.0.0.2:5000" {
+        t.Errorf("PeerURL = %q, %v, want the URL 10.0.0.2 wrote", url, ok)
+    }
+
+    // 10.0.0.2 keeps heartbeating while 10.0.0.3 stopped
+    later := start.Add(10 * time.Second)
+    if got, want := s.observe(data(behind.Add(10*time.Second), ahead), later), (podSet{"10.0.0.1": true, "10.0.0.2": true, "10.0.0.3": true}); !reflect.DeepEqual(got, want) {
+        t.Fatalf("live peers = %v, want %v within the TTL", got, want)
+    }
+    later = start.Add(20 * time.Second)
+    if got, want := s.observe(data(behind.Add(20*time.Second), ahead), later), (podSet{"10.0.0.1": true, "10.0.0.2": true}); !reflect.DeepEqual(got, want) {
+        t.Fatalf("live peers = %v, want %v once 10.0.0.3 has not heartbeat for longer than the TTL", got, want)
+    }
+    if _, ok := s.PeerURL("10.0.0.3"); ok {
+        t.Errorf("PeerURL still knows expired peer 10.0.0.3")
+    }
+}
@@ -6,8 +6,10 @@ import (
     "k8s.io/api/core/v1"
     metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
     "k8s.io/client-go/rest"
+    "k8s.io/apimachinery/pkg/watch"
     "fmt"
     "errors"
+    "time"
 )
 
 type config struct {
@@ -16,46 +18,118 @@ type config struct {
 
 var libConfig config
 
+// namespace is the Kubernetes namespace peers are discovered in.
+const namespace = "default"
+
 func debugLogf(format string, v ...interface{}) {
     if libConfig.debugMode {
         log.Printf(format, v...)
     }
 }
 
-func getInitialPods(clientset *kubernetes.Clientset, listOptions metav1.ListOptions, myIp string) (podSet, error) {
-    pods, err := clientset.CoreV1().Pods("default").List(listOptions)
+const (
+    minRetryDelay = 1 * time.Second
+    maxRetryDelay = 30 * time.Second
+)
+
+func nextRetryDelay(delay time.Duration) time.Duration {
+    delay *= 2
+    if delay > maxRetryDelay {
+        delay = maxRetryDelay
+    }
+    return delay
+}
+
+// getInitialPods lists the ready pods, returning their ips along with the resourceVersion of the list
+// so that a watch can pick up exactly where the list left off.
+// myIp is always included (whether ready yet or not), unless onlyIfListed is set and the current pod does not
+// match listOptions.
+func getInitialPods(clientset kubernetes.Interface, listOptions metav1.ListOptions, myIp string, onlyIfListed bool) (podSet, string, error) {
+    pods, err := clientset.CoreV1().Pods(namespace).List(listOptions)
     if err != nil {
-        return nil, err
+        return nil, "", err
     }
     podSet := make(podSet)
-    podSet[myIp] = true
+    if !onlyIfListed {
+        podSet[myIp] = true
+    }
     for _, pod := range pods.Items {
         podIp := pod.Status.PodIP
-        if isPodReady(&pod) && podIp != myIp {
+        if podIp == myIp || isPodReady(&pod) {
             podSet[podIp] = true
         }
     }
-    return podSet, nil
+    return podSet, pods.ResourceVersion, nil
 }
 
-func monitorPodState(clientset *kubernetes.Clientset, listOptions metav1.ListOptions, myIp string, initialPods podSet, f NotifyFunc) {
-    // When a kube pod is ADDED or DELETED, it goes through several changes which issue MODIFIED events.
-    // By watching these MODIFIED events for times when we see a given podIp associated with a Pod READY condition
-    // set to true or false, we can keep track of all pod ip addresses which are ready to receive connections.
+// notifyDifferences notifies of every pod which is in exactly one of oldPods and newPods.
+func notifyDifferences(oldPods podSet, newPods podSet, myIp string, notify NotifyFunc) {
+    for podIp := range newPods {
+        if podIp != myIp && !oldPods[podIp] {
+            notify(podIp, Added)
+        }
+    }
+    for podIp := range oldPods {
+        if podIp != myIp && !newPods[podIp] {
+            notify(podIp, Removed)
+        }
+    }
+}
 
-    podSet := initialPods
+// monitorPodState keeps podSet in sync with the Kubernetes API forever, calling notify synchronously for every change.
+// Watches regularly end (API server timeouts, expired resource versions, the API being unavailable),
+// so whenever one does the pods are listed again, with exponential backoff, and any changes missed in between are
+// notified before watching resumes. An empty resourceVersion forces that list to happen first.
+func monitorPodState(clientset kubernetes.Interface, listOptions metav1.ListOptions, myIp string, podSet podSet, resourceVersion string, notify NotifyFunc) {
     debugLogf("Initial pod list = %v", podSet)
 
-    // begin watch API call
-    watchInterface, err := clientset.CoreV1().Pods("default").Watch(listOptions)
-    if err != nil {
-        debugLogf("WARNING: error watching pods: %v", err)
-        return
+    retryDelay := minRetryDelay
+    for {
+        if resourceVersion == "" {
+            pods, listResourceVersion, err := getInitialPods(clientset, listOptions, myIp, false)
+            if err != nil {
+                debugLogf("WARNING: error listing pods, retrying in %v: %v", retryDelay, err)
+                time.Sleep(retryDelay)
+                retryDelay = nextRetryDelay(retryDelay)
+                continue
+            }
+            notifyDifferences(podSet, pods, myIp, notify)
+            podSet, resourceVersion = pods, listResourceVersion
+            debugLogf("Resynchronized pod list = %v", podSet)
+        }
+
+        // begin watch API call
+        watchOptions := listOptions
+        watchOptions.ResourceVersion = resourceVersion
+        watchInterface, err := clientset.CoreV1().Pods(namespace).Watch(watchOptions)
+        if err != nil {
+            debugLogf("WARNING: error watching pods, retrying in %v: %v", retryDelay, err)
+            time.Sleep(retryDelay)
+            retryDelay = nextRetryDelay(retryDelay)
+            resourceVersion = ""
+            continue
+        }
+        retryDelay = minRetryDelay
+
+        watchPodState(watchInterface, myIp, podSet, notify)
+        watchInterface.Stop()
+        debugLogf("Pod watch ended, resynchronizing")
+        resourceVersion = ""
     }
+}
+
+func watchPodState(watchInterface watch.Interface, myIp string, podSet podSet, notify NotifyFunc) {
+    // When a kube pod is ADDED or DELETED, it goes through several changes which issue MODIFIED events.
+    // By watching these MODIFIED events for times when we see a given podIp associated with a Pod READY condition
+    // set to true or false, we can keep track of all pod ip addresses which are ready to receive connections.
 
     // React to watch result channel
     ch := watchInterface.ResultChan()
     for event := range ch {
+        if event.Type == "ERROR" {
+            debugLogf("WARNING: got error from pod watching: %v", event.Object)
+            return
+        }
         pod, ok := event.Object.(*v1.Pod)
         if !ok {
             debugLogf("WARNING: got non-pod object from pod watching: %v", event.Object)
@@ -74,18 +148,20 @@ func monitorPodState(clientset *kubernetes.Clientset, listOptions metav1.ListOpt
             debugLogf("MODIFIED pod %s with ip %s. Ready = %v", podName, podIp, podReady)
         case "DELETED":
             debugLogf("DELETED pod %s with ip %s. Ready = %v", podName, podIp, podReady)
+            // normally preceded by a MODIFIED event dropping readiness, but that may have been missed while resynchronizing
+            podReady = false
         }
 
-        // Main events we care about: MODIFIED including a PodIp other than current pod's IP
-        if event.Type == "MODIFIED" && podIp != "" && podIp != myIp {
+        // Main events we care about: MODIFIED (or DELETED) including a PodIp other than current pod's IP
+        if (event.Type == "MODIFIED" || event.Type == "DELETED") && podIp != "" && podIp != myIp {
             if podReady && !podSet[podIp] {
                 debugLogf("Newly ready pod %s @ %s", podName, podIp)
                 podSet[podIp] = true
-                go f(podIp, Added)
+                notify(podIp, Added)
             } else if !podReady && podSet[podIp] {
                 debugLogf("Newly disappeared pod %s @ %s", podName, podIp)
                 delete(podSet, podIp)
-                go f(podIp, Removed)
+                notify(podIp, Removed)
             } else {
                 continue // no change to pod list
             }
@@ -102,6 +178,15 @@ func isPodReady(pod *v1.Pod) bool {
     return false
 }
 
+// newInClusterClient sets up a Kube api connection, using the in-cluster config. This assumes the app is running in a pod.
+func newInClusterClient() (*kubernetes.Clientset, error) {
+    config, err := rest.InClusterConfig()
+    if err != nil {
+        return nil, err
+    }
+    return kubernetes.NewForConfig(config)
+}
+
 type NotifyState int
 const (
     Added   NotifyState = 1
@@ -116,24 +201,19 @@ type NotifyFunc func(ip string, state NotifyState)
 //
 // myIp is the IP of the current pod
 // listOptions will be used in the calls to Kubernetes API, to filter to desired pods (e.g. by LabelSelector)
-// f is a NotifyFunc that lets you do whatever you want with the incoming pod change events. Note this will be called in goroutines so should include thread-safe logic.
+// f is a NotifyFunc that lets you do whatever you want with the incoming pod change events. Note this will be called from a background goroutine, one change at a time in the order they happened, so should include thread-safe logic and not block for long.
 // debugMode controls whether to log debug messages or not
 func Init(myIp string, listOptions metav1.ListOptions, f NotifyFunc, debugMode bool) ([]string, error) {
 
     libConfig.debugMode = debugMode
 
-    // Setup Kube api connection, using the in-cluster config. This assumes the app is running in a pod.
-    config, err := rest.InClusterConfig()
-    if err != nil {
-        return nil, err
-    }
-    kubeClient, err := kubernetes.NewForConfig(config)
+    kubeClient, err := newInClusterClient()
     if err != nil {
         return nil, err
     }
 
     // Fetch initial pods from API
-    initialPods, err := getInitialPods(kubeClient, listOptions, myIp)
+    initialPods, resourceVersion, err := getInitialPods(kubeClient, listOptions, myIp, false)
     if err != nil {
         return nil, fmt.Errorf("could not get initial pod list: %v", err)
     }
@@ -143,7 +223,7 @@ func Init(myIp string, listOptions metav1.ListOptions, f NotifyFunc, debugMode b
     podIps := initialPods.Keys()
 
     // Start monitoring for pod transitions, to keep pool up to date
-    go monitorPodState(kubeClient, listOptions, myIp, initialPods, f)
+    go monitorPodState(kubeClient, listOptions, myIp, initialPods, resourceVersion, f)
 
     return podIps, nil
 }
\ No newline at end of file
@@ -0,0 +1,90 @@
+package peerwatch
+
+import (
+    "time"
+    "k8s.io/api/core/v1"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/apimachinery/pkg/watch"
+    "k8s.io/client-go/kubernetes"
+)
+
+// podIndex is something known about every pod (whether ready or not), keyed by ip, which monitorPods keeps in sync
+// with the Kubernetes API.
+type podIndex interface {
+    // reset replaces the whole index with the given pods, returning whether anything changed.
+    reset(pods []v1.Pod) bool
+    // update applies a pod which was added, modified or deleted, returning whether anything changed.
+    update(pod *v1.Pod, deleted bool) bool
+}
+
+// listPods lists the pods matching listOptions into index, returning whether it changed and the resourceVersion of
+// the list.
+func listPods(clientset kubernetes.Interface, listOptions metav1.ListOptions, index podIndex) (bool, string, error) {
+    pods, err := clientset.CoreV1().Pods(namespace).List(listOptions)
+    if err != nil {
+        return false, "", err
+    }
+    return index.reset(pods.Items), pods.ResourceVersion, nil
+}
+
+// monitorPods keeps index in sync with the Kubernetes API forever, calling changed after every change. Like
+// monitorPodState, it lists the pods again whenever a watch ends; an empty resourceVersion forces that list to
+// happen first.
+func monitorPods(clientset kubernetes.Interface, listOptions metav1.ListOptions, index podIndex, resourceVersion string, changed func()) {
+    retryDelay := minRetryDelay
+    for {
+        if resourceVersion == "" {
+            listChanged, listResourceVersion, err := listPods(clientset, listOptions, index)
+            if err != nil {
+                debugLogf("WARNING: error listing pods, retrying in %v: %v", retryDelay, err)
+                time.Sleep(retryDelay)
+                retryDelay = nextRetryDelay(retryDelay)
+                continue
+            }
+            if listChanged {
+                changed()
+            }
+            resourceVersion = listResourceVersion
+        }
+
+        watchOptions := listOptions
+        watchOptions.ResourceVersion = resourceVersion
+        watchInterface, err := clientset.CoreV1().Pods(namespace).Watch(watchOptions)
+        if err != nil {
+            debugLogf("WARNING: error watching pods, retrying in %v: %v", retryDelay, err)
+            time.Sleep(retryDelay)
+            retryDelay = nextRetryDelay(retryDelay)
+            resourceVersion = ""
+            continue
+        }
+        retryDelay = minRetryDelay
+
+        for event := range watchInterface.ResultChan() {
+            if event.Type == watch.Error {
+                debugLogf("WARNING: got error from pod watching: %v", event.Object)
+                break
+            }
+            pod, ok := event.Object.(*v1.Pod)
+            if !ok || pod.Status.PodIP == "" {
+                continue
+            }
+            if index.update(pod, event.Type == watch.Deleted) {
+                changed()
+            }
+        }
+        watchInterface.Stop()
+        resourceVersion = ""
+    }
+}
+
+// startPodIndex lists the pods matching listOptions into index, calling changed if it did, and then keeps index in
+// sync from a goroutine. If the pods cannot be listed at first, the error is returned and they are listed again in
+// the background, with backoff.
+func startPodIndex(clientset kubernetes.Interface, listOptions metav1.ListOptions, index podIndex, changed func()) error {
+    listChanged, resourceVersion, err := listPods(clientset, listOptions, index)
+    if err == nil && listChanged {
+        changed()
+    }
+    go monitorPods(clientset, listOptions, index, resourceVersion, changed)
+    return err
+}
@@ -0,0 +1,23 @@
+package peerwatch
+
+import (
+    "fmt"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// shardListOptions narrows listOptions down to the pods whose shardLabel has the given value.
+func shardListOptions(listOptions metav1.ListOptions, shardLabel string, shard string) metav1.ListOptions {
+    selector := fmt.Sprintf("%s=%s", shardLabel, shard)
+    if listOptions.LabelSelector != "" {
+        selector = listOptions.LabelSelector + "," + selector
+    }
+    listOptions.LabelSelector = selector
+    return listOptions
+}
+
+// ShardSource is a Source of the pods of a single shard, i.e. those matching listOptions whose shardLabel
+// label is set to shard. The current pod is only one of them if it belongs to that shard.
+func ShardSource(listOptions metav1.ListOptions, shardLabel string, shard string) PodSource {
+    return PodSource{ListOptions: shardListOptions(listOptions, shardLabel, shard)}
+}
+
@@ -0,0 +1,51 @@
+package peerwatch
+
+import (
+    "fmt"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Source is a way of discovering a set of peers. Unlike Init, any number of Sources can be started side by side,
+// e.g. to give different groups different peers.
+type Source interface {
+    // Start returns the initial peer ips, and then keeps notifying f of changes to them like Init: from a background
+    // goroutine, one change at a time in the order they happened, so that an ip which is Removed and Added again
+    // ends up as a peer.
+    Start(myIp string, f NotifyFunc) ([]string, error)
+}
+
+// URLSource is a Source which knows the base URL each peer advertises, e.g. because peers publish it themselves.
+type URLSource interface {
+    Source
+    // PeerURL returns the base URL of the peer with the given ip, if known. It is called while f is being
+    // notified that the peer was Added, and for the initial peers once Start returns.
+    PeerURL(ip string) (string, bool)
+}
+
+// SetDebugMode controls whether to log debug messages or not, for Sources started without calling an Init function.
+func SetDebugMode(debugMode bool) {
+    libConfig.debugMode = debugMode
+}
+
+// PodSource discovers the ready pods matching ListOptions, as Init does. Unlike Init, the current pod is
+// only one of the peers if it matches ListOptions itself, so a pod can take part in groups whose peers
+// are a subset it does not belong to.
+type PodSource struct {
+    ListOptions metav1.ListOptions
+}
+
+func (s PodSource) Start(myIp string, f NotifyFunc) ([]string, error) {
+    kubeClient, err := newInClusterClient()
+    if err != nil {
+        return nil, err
+    }
+
+    initialPods, resourceVersion, err := getInitialPods(kubeClient, s.ListOptions, myIp, true)
+    if err != nil {
+        return nil, fmt.Errorf("could not get initial pod list for %q: %v", s.ListOptions.LabelSelector, err)
+    }
+
+    go monitorPodState(kubeClient, s.ListOptions, myIp, initialPods, resourceVersion, f)
+
+    return initialPods.Keys(), nil
+}
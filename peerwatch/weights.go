@@ -0,0 +1,129 @@
+package peerwatch
+
+import (
+    "strconv"
+    "k8s.io/api/core/v1"
+    "k8s.io/apimachinery/pkg/api/resource"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// WeightAnnotation sets the weight of a pod explicitly, e.g. "2" for a pod which should own twice as many keys as
+// a pod of weight 1. It takes precedence over the pod's resources.
+const WeightAnnotation = "peer-aware-groupcache/weight"
+
+// Weigher derives the weights of peers from their pods: from WeightAnnotation if set, otherwise from the amount of
+// Resource of the pod's containers, in Units. Pods weigh 1 when neither applies.
+type Weigher struct {
+    // Resource weighs pods by the amount of it their containers request, e.g. v1.ResourceMemory. Empty to only
+    // weigh pods by WeightAnnotation.
+    Resource v1.ResourceName
+    // Limits weighs pods by the limits of their containers rather than their requests, falling back to the
+    // request of containers without a limit.
+    Limits bool
+    // Unit is the amount of Resource of a pod of weight 1, e.g. resource.MustParse("1Gi").
+    Unit resource.Quantity
+}
+
+// Weight returns the weight of pod.
+func (w Weigher) Weight(pod *v1.Pod) float64 {
+    if value, ok := pod.Annotations[WeightAnnotation]; ok {
+        weight, err := strconv.ParseFloat(value, 64)
+        if err == nil && weight > 0 {
+            return weight
+        }
+        debugLogf("WARNING: ignoring bad %s annotation %q of pod %s", WeightAnnotation, value, pod.Name)
+    }
+    if w.Resource == "" || w.Unit.IsZero() {
+        return 1
+    }
+    var total resource.Quantity
+    for _, container := range pod.Spec.Containers {
+        amount, ok := container.Resources.Requests[w.Resource]
+        if limit, hasLimit := container.Resources.Limits[w.Resource]; w.Limits && hasLimit {
+            amount, ok = limit, true
+        }
+        if ok {
+            total.Add(amount)
+        }
+    }
+    if total.IsZero() {
+        return 1
+    }
+    return float64(total.MilliValue()) / float64(w.Unit.MilliValue())
+}
+
+// WeightNotifyFunc is called with the weights of every pod, keyed by ip, whenever any of them changes.
+type WeightNotifyFunc func(weights map[string]float64)
+
+// WatchWeights calls f with the weights of the pods matching listOptions, as weighed by weigher, and then keeps
+// notifying f of changes to them from a goroutine. Pods are weighed whether ready or not, so that peers have their
+// weight as soon as they join.
+//
+// If the pods cannot be listed at first, the error is returned and they are listed again in the background, with
+// backoff, until f can be called with their weights.
+func WatchWeights(listOptions metav1.ListOptions, weigher Weigher, f WeightNotifyFunc) error {
+    kubeClient, err := newInClusterClient()
+    if err != nil {
+        return err
+    }
+    index := &weightIndex{weigher: weigher, weights: make(map[string]float64)}
+    return startPodIndex(kubeClient, listOptions, index, func() {
+        f(copyWeights(index.weights))
+    })
+}
+
+// weightIndex is the weight of every pod.
+type weightIndex struct {
+    weigher Weigher
+    weights map[string]float64 // keyed by pod ip
+}
+
+func (x *weightIndex) reset(pods []v1.Pod) bool {
+    weights := make(map[string]float64, len(pods))
+    for _, pod := range pods {
+        if pod.Status.PodIP != "" {
+            weights[pod.Status.PodIP] = x.weigher.Weight(&pod)
+        }
+    }
+    if sameWeights(x.weights, weights) {
+        return false
+    }
+    x.weights = weights
+    return true
+}
+
+func (x *weightIndex) update(pod *v1.Pod, deleted bool) bool {
+    ip := pod.Status.PodIP
+    current, ok := x.weights[ip]
+    if deleted {
+        delete(x.weights, ip)
+        return ok
+    }
+    weight := x.weigher.Weight(pod)
+    if ok && current == weight {
+        return false
+    }
+    debugLogf("Pod %s @ %s weighs %v", pod.Name, ip, weight)
+    x.weights[ip] = weight
+    return true
+}
+
+func sameWeights(a map[string]float64, b map[string]float64) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for ip, weight := range a {
+        if other, ok := b[ip]; !ok || other != weight {
+            return false
+        }
+    }
+    return true
+}
+
+func copyWeights(weights map[string]float64) map[string]float64 {
+    copied := make(map[string]float64, len(weights))
+    for ip, weight := range weights {
+        copied[ip] = weight
+    }
+    return copied
+}
@@ -0,0 +1,104 @@
+package peerwatch
+
+import (
+    "k8s.io/api/core/v1"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/client-go/kubernetes"
+)
+
+// ZoneLabels are the node labels a pod's zone is read from, in order of preference: the current topology label,
+// and the deprecated one older clusters still set.
+var ZoneLabels = []string{"topology.kubernetes.io/zone", "failure-domain.beta.kubernetes.io/zone"}
+
+// ZoneNotifyFunc is called with the zone of every pod, keyed by ip, whenever any of them changes. Pods whose zone
+// is not known yet (e.g. not scheduled yet) are missing.
+type ZoneNotifyFunc func(zones map[string]string)
+
+// WatchZones calls f with the zones of the pods matching listOptions, from the topology labels of the nodes they
+// run on, and then keeps notifying f of changes to them from a goroutine. Reading nodes requires permission to get
+// them, cluster-wide.
+//
+// If the pods cannot be listed at first, the error is returned and they are listed again in the background, with
+// backoff, until f can be called with their zones.
+func WatchZones(listOptions metav1.ListOptions, f ZoneNotifyFunc) error {
+    kubeClient, err := newInClusterClient()
+    if err != nil {
+        return err
+    }
+    index := &zoneIndex{clientset: kubeClient, zones: make(map[string]string), nodes: make(map[string]string)}
+    return startPodIndex(kubeClient, listOptions, index, func() {
+        zones := make(map[string]string, len(index.zones))
+        for ip, zone := range index.zones {
+            zones[ip] = zone
+        }
+        f(zones)
+    })
+}
+
+// zoneIndex is the zone of every pod.
+type zoneIndex struct {
+    clientset kubernetes.Interface
+    zones     map[string]string // keyed by pod ip
+    nodes     map[string]string // zones keyed by node name, as nodes do not change zone
+}
+
+// zone returns the zone of pod, or "" if it is not known.
+func (x *zoneIndex) zone(pod *v1.Pod) string {
+    nodeName := pod.Spec.NodeName
+    if nodeName == "" {
+        return ""
+    }
+    if zone, ok := x.nodes[nodeName]; ok {
+        return zone
+    }
+    node, err := x.clientset.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+    if err != nil {
+        // retried with the next change to the pod, or the next list
+        debugLogf("WARNING: error getting node %s of pod %s: %v", nodeName, pod.Name, err)
+        return ""
+    }
+    zone := ""
+    for _, label := range ZoneLabels {
+        if zone = node.Labels[label]; zone != "" {
+            break
+        }
+    }
+    x.nodes[nodeName] = zone
+    return zone
+}
+
+func (x *zoneIndex) reset(pods []v1.Pod) bool {
+    zones := make(map[string]string, len(pods))
+    for _, pod := range pods {
+        if zone := x.zone(&pod); pod.Status.PodIP != "" && zone != "" {
+            zones[pod.Status.PodIP] = zone
+        }
+    }
+    changed := len(zones) != len(x.zones)
+    for ip, zone := range zones {
+        if x.zones[ip] != zone {
+            changed = true
+        }
+    }
+    x.zones = zones
+    return changed
+}
+
+func (x *zoneIndex) update(pod *v1.Pod, deleted bool) bool {
+    ip := pod.Status.PodIP
+    current := x.zones[ip]
+    zone := ""
+    if !deleted {
+        zone = x.zone(pod)
+    }
+    if zone == current {
+        return false
+    }
+    if zone == "" {
+        delete(x.zones, ip)
+    } else {
+        debugLogf("Pod %s @ %s is in zone %s", pod.Name, ip, zone)
+        x.zones[ip] = zone
+    }
+    return true
+}
@@ -0,0 +1,263 @@
+package ring
+
+import (
+    "sort"
+    "sync"
+    "time"
+    "github.com/robwil/peer-aware-groupcache/groupcache"
+    pb "github.com/golang/groupcache/groupcachepb"
+)
+
+const (
+    defaultBreakerWindow      = 10 * time.Second
+    defaultBreakerMinRequests = 10
+    defaultBreakerErrorRate   = 0.5
+    defaultBreakerCooldown    = 5 * time.Second
+)
+
+// BreakerOptions configures a Breaker.
+type BreakerOptions struct {
+    // Window is the period over which each peer's error rate is measured. Defaults to 10 seconds.
+    Window time.Duration
+    // MinRequests is how many requests a peer must have had within the window before its circuit can open.
+    // Defaults to 10.
+    MinRequests int
+    // ErrorRate is the fraction of failed requests within the window at which a peer's circuit opens.
+    // Defaults to 0.5.
+    ErrorRate float64
+    // SlowCall is how long a request may take before it counts as failed, even though it succeeded eventually.
+    // Defaults to 0, which only counts errors (including timeouts, see Options.PeerTimeout).
+    SlowCall time.Duration
+    // Cooldown is how long a peer's circuit stays open before a single request is let through to probe whether
+    // the peer has recovered. Defaults to 5 seconds.
+    Cooldown time.Duration
+}
+
+// BreakerStats are statistics on the circuits of a Breaker.
+type BreakerStats struct {
+    Opened   groupcache.AtomicInt // circuits opened, including after failed probes
+    Closed   groupcache.AtomicInt // circuits closed after successful probes
+    Probes   groupcache.AtomicInt
+    Rerouted groupcache.AtomicInt // keys of open peers sent to the next peer of the ring, or loaded locally
+}
+
+type circuitState int
+
+const (
+    circuitClosed circuitState = iota
+    circuitOpen
+    circuitHalfOpen // a probe is in flight
+)
+
+// circuit tracks the requests to one peer.
+type circuit struct {
+    state       circuitState
+    openedAt    time.Time
+    windowStart time.Time
+    requests    int
+    failures    int
+    unreachable bool // see SetReachable
+}
+
+// Breaker is a groupcache.PeerPicker which picks peers from a Pool, but stops sending requests to peers which
+// fail too often, as Kubernetes readiness can lag behind a peer which times out or errors. The keys of such a
+// peer go to the peer which would own them if it was not part of the ring, or are loaded locally if that is the
+// current peer. After a cooldown, a single request probes whether the peer has recovered. Peers can also be
+// routed around because a health check found them unreachable, see SetReachable.
+//
+// Use Rings.SetPicker to have the groups of a ring pick their peers through a Breaker.
+type Breaker struct {
+    pool *Pool
+    opts BreakerOptions
+
+    mu       sync.Mutex          // guards circuits and healthy
+    circuits map[string]*circuit // keyed by peer base URL
+    healthy  Hash                // ring without the peers whose circuit is not closed, nil until needed
+
+    Stats BreakerStats
+}
+
+// NewBreaker creates a Breaker picking peers from pool. opts may be nil to use the defaults.
+func NewBreaker(pool *Pool, opts *BreakerOptions) *Breaker {
+    b := &Breaker{pool: pool, circuits: make(map[string]*circuit)}
+    if opts != nil {
+        b.opts = *opts
+    }
+    if b.opts.Window <= 0 {
+        b.opts.Window = defaultBreakerWindow
+    }
+    if b.opts.MinRequests <= 0 {
+        b.opts.MinRequests = defaultBreakerMinRequests
+    }
+    if b.opts.ErrorRate <= 0 {
+        b.opts.ErrorRate = defaultBreakerErrorRate
+    }
+    if b.opts.Cooldown <= 0 {
+        b.opts.Cooldown = defaultBreakerCooldown
+    }
+    pool.Subscribe(b.peersChanged)
+    return b
+}
+
+func (b *Breaker) peersChanged(_ []string, current []string) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    peers := make(map[string]bool, len(current))
+    for _, peer := range current {
+        peers[peer] = true
+    }
+    for peer := range b.circuits {
+        if !peers[peer] {
+            delete(b.circuits, peer)
+        }
+    }
+    b.healthy = nil
+}
+
+func (b *Breaker) PickPeer(key string) (groupcache.ProtoGetter, bool) {
+    owner := b.pool.Owner(key)
+    if owner == "" || owner == b.pool.Self() {
+        return nil, false
+    }
+
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    c := b.circuits[owner]
+    if c != nil && !c.unreachable && c.state == circuitOpen && time.Since(c.openedAt) >= b.opts.Cooldown {
+        c.state = circuitHalfOpen
+        b.Stats.Probes.Add(1)
+        return b.getter(owner)
+    }
+    if c != nil && (c.unreachable || c.state != circuitClosed) {
+        b.Stats.Rerouted.Add(1)
+        if b.healthy == nil {
+            b.healthy = b.pool.newHash(b.closedPeers())
+        }
+        owner = b.healthy.Get(key)
+        if owner == "" || owner == b.pool.Self() {
+            return nil, false
+        }
+    }
+    return b.getter(owner)
+}
+
+// PickPreviousPeer implements groupcache.PreviousPeerPicker, see Pool.PickPreviousPeer.
+func (b *Breaker) PickPreviousPeer(key string) (groupcache.ProtoGetter, bool) {
+    return b.pool.PickPreviousPeer(key)
+}
+
+// closedPeers returns the pool's reachable peers whose circuit is closed.
+func (b *Breaker) closedPeers() []string {
+    var peers []string
+    for _, peer := range b.pool.Peers() {
+        if c := b.circuits[peer]; c == nil || (c.state == circuitClosed && !c.unreachable) {
+            peers = append(peers, peer)
+        }
+    }
+    return peers
+}
+
+func (b *Breaker) getter(peer string) (groupcache.ProtoGetter, bool) {
+    getter, ok := b.pool.getter(peer)
+    if !ok {
+        return nil, false
+    }
+    return &breakerGetter{breaker: b, peer: peer, getter: getter}, true
+}
+
+// record updates the circuit of peer with the outcome of a request to it.
+func (b *Breaker) record(peer string, failed bool, abandoned bool) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    c := b.circuits[peer]
+    if c == nil {
+        if abandoned {
+            return
+        }
+        c = &circuit{}
+        b.circuits[peer] = c
+    }
+    now := time.Now()
+    switch c.state {
+    case circuitHalfOpen:
+        switch {
+        case abandoned:
+            // probe again with the next request
+            c.state = circuitOpen
+            c.openedAt = now.Add(-b.opts.Cooldown)
+        case failed:
+            c.state = circuitOpen
+            c.openedAt = now
+            b.Stats.Opened.Add(1)
+        default:
+            *c = circuit{state: circuitClosed, windowStart: now}
+            b.healthy = nil
+            b.Stats.Closed.Add(1)
+        }
+    case circuitClosed:
+        if abandoned {
+            return
+        }
+        if now.Sub(c.windowStart) >= b.opts.Window {
+            c.windowStart, c.requests, c.failures = now, 0, 0
+        }
+        c.requests++
+        if failed {
+            c.failures++
+        }
+        if c.requests >= b.opts.MinRequests && float64(c.failures) >= b.opts.ErrorRate*float64(c.requests) {
+            c.state = circuitOpen
+            c.openedAt = now
+            b.healthy = nil
+            b.Stats.Opened.Add(1)
+        }
+    }
+}
+
+// SetReachable marks a peer as unreachable from the current peer, e.g. by a Prober, or as reachable again. The keys
+// of an unreachable peer are rerouted as if its circuit was open, without probing it, until it is marked reachable.
+func (b *Breaker) SetReachable(peer string, reachable bool) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    c := b.circuits[peer]
+    if c == nil {
+        if reachable {
+            return
+        }
+        c = &circuit{windowStart: time.Now()}
+        b.circuits[peer] = c
+    }
+    if c.unreachable == reachable {
+        c.unreachable = !reachable
+        b.healthy = nil
+    }
+}
+
+// Open returns the peers whose circuit is currently open (or being probed), sorted.
+func (b *Breaker) Open() []string {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    var peers []string
+    for peer, c := range b.circuits {
+        if c.state != circuitClosed {
+            peers = append(peers, peer)
+        }
+    }
+    sort.Strings(peers)
+    return peers
+}
+
+// breakerGetter reports the outcome of each request to a peer to its Breaker.
+type breakerGetter struct {
+    breaker *Breaker
+    peer    string
+    getter  groupcache.ProtoGetter
+}
+
+func (g *breakerGetter) Get(ctx groupcache.Context, in *pb.GetRequest, out *pb.GetResponse) error {
+    start := time.Now()
+    err := g.getter.Get(ctx, in, out)
+    slow := g.breaker.opts.SlowCall > 0 && time.Since(start) > g.breaker.opts.SlowCall
+    g.breaker.record(g.peer, err != nil || slow, RequestContext(ctx).Err() != nil)
+    return err
+}
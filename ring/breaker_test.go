@@ -0,0 +1,136 @@
+package ring_test
+
+import (
+    "context"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "sync/atomic"
+    "testing"
+    "time"
+    pb "github.com/golang/groupcache/groupcachepb"
+    "github.com/golang/protobuf/proto"
+    "github.com/robwil/peer-aware-groupcache/ring"
+)
+
+// peer behaviours
+const (
+    answer int32 = iota
+    fail
+    slow
+)
+
+// flakyPeer answers requests as told by the returned behaviour.
+func flakyPeer(t *testing.T) (*httptest.Server, *int32) {
+    behaviour := new(int32)
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch atomic.LoadInt32(behaviour) {
+        case fail:
+            http.Error(w, "failing", http.StatusInternalServerError)
+            return
+        case slow:
+            time.Sleep(50 * time.Millisecond)
+        }
+        body, _ := proto.Marshal(&pb.GetResponse{Value: []byte("value")})
+        w.Write(body)
+    }))
+    t.Cleanup(server.Close)
+    return server, behaviour
+}
+
+// breakerStep is a request made through a Breaker, after waiting for wait, while the peer behaves as told.
+type breakerStep struct {
+    wait       time.Duration
+    behaviour  int32
+    wantPicked bool // whether the peer is picked, rather than its key being rerouted
+    wantOpen   bool // whether the peer's circuit is open once the request is done
+}
+
+func TestBreaker(t *testing.T) {
+    const cooldown = 100 * time.Millisecond
+    failures := []breakerStep{
+        {behaviour: fail, wantPicked: true},
+        {behaviour: fail, wantPicked: true},
+        {behaviour: answer, wantPicked: true},
+        {behaviour: fail, wantPicked: true, wantOpen: true}, // 3 of 4 failed
+        {behaviour: answer, wantOpen: true},                 // rerouted during the cooldown
+    }
+    tests := []struct {
+        name     string
+        slowCall time.Duration
+        steps    []breakerStep
+    }{
+        {"answers keep it closed", 0, []breakerStep{
+            {behaviour: answer, wantPicked: true},
+            {behaviour: answer, wantPicked: true},
+            {behaviour: answer, wantPicked: true},
+            {behaviour: fail, wantPicked: true},
+            {behaviour: answer, wantPicked: true},
+        }},
+        {"probe closes it", 0, append(failures[:len(failures):len(failures)],
+            breakerStep{wait: cooldown, behaviour: answer, wantPicked: true}, // half-open, then closed
+            breakerStep{behaviour: answer, wantPicked: true},
+        )},
+        {"failed probe opens it again", 0, append(failures[:len(failures):len(failures)],
+            breakerStep{wait: cooldown, behaviour: fail, wantPicked: true, wantOpen: true},
+            breakerStep{behaviour: answer, wantOpen: true},
+            breakerStep{wait: cooldown, behaviour: answer, wantPicked: true},
+        )},
+        {"slow calls count as failures", 20 * time.Millisecond, []breakerStep{
+            {behaviour: slow, wantPicked: true},
+            {behaviour: slow, wantPicked: true},
+            {behaviour: answer, wantPicked: true},
+            {behaviour: slow, wantPicked: true, wantOpen: true},
+            {behaviour: answer, wantOpen: true},
+            {wait: cooldown, behaviour: slow, wantPicked: true, wantOpen: true},
+        }},
+        {"slow calls are fine without SlowCall", 0, []breakerStep{
+            {behaviour: slow, wantPicked: true},
+            {behaviour: slow, wantPicked: true},
+            {behaviour: slow, wantPicked: true},
+            {behaviour: slow, wantPicked: true},
+        }},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            const self = "http://self"
+            peer, behaviour := flakyPeer(t)
+            pool := ring.NewPool(self, nil)
+            pool.Set(self, peer.URL)
+            breaker := ring.NewBreaker(pool, &ring.BreakerOptions{
+                Window:      time.Minute,
+                MinRequests: 4,
+                SlowCall:    tt.slowCall,
+                Cooldown:    cooldown,
+            })
+            key := keyOwnedBy(t, pool, peer.URL)
+
+            for i, step := range tt.steps {
+                time.Sleep(step.wait)
+                atomic.StoreInt32(behaviour, step.behaviour)
+                getter, picked := breaker.PickPeer(key)
+                if picked != step.wantPicked {
+                    t.Fatalf("step %d: picked peer = %v, want %v", i, picked, step.wantPicked)
+                }
+                if picked {
+                    in := &pb.GetRequest{Group: proto.String("breaker"), Key: proto.String(key)}
+                    getter.Get(context.Background(), in, &pb.GetResponse{})
+                }
+                if open := len(breaker.Open()) > 0; open != step.wantOpen {
+                    t.Fatalf("step %d: open = %v, want %v", i, open, step.wantOpen)
+                }
+            }
+        })
+    }
+}
+
+// keyOwnedBy returns a key which peer owns in pool.
+func keyOwnedBy(t *testing.T, pool *ring.Pool, peer string) string {
+    for i := 0; i < 1000; i++ {
+        if key := fmt.Sprint("key-", i); pool.Owner(key) == peer {
+            return key
+        }
+    }
+    t.Fatalf("%s owns none of the keys", peer)
+    return ""
+}
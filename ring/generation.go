@@ -0,0 +1,96 @@
+package ring
+
+import (
+    "strconv"
+    "strings"
+    "sync"
+    "github.com/robwil/peer-aware-groupcache/groupcache"
+)
+
+// Generations are the generation numbers of groups, which are mixed into their keys, so that bumping the generation
+// of a group retires every value cached for it at once, on every peer: keys of the new generation miss every cache,
+// and values of older generations are never read again, and left for the LRU to evict. Bump generations when what
+// a group's getter returns changes, e.g. with peerwatch.BumpGeneration, and keep every peer in agreement with
+// peerwatch.WatchGenerations.
+//
+// Generations are counted within an epoch, which tells apart the places they are stored in, e.g. the UID of their
+// ConfigMap: if that ConfigMap is deleted and created again, its generations start over from 1 in a new epoch.
+//
+// A group's keys are mixed with its epoch and generation by Key, e.g. "5d0b6e2a.3:12345", and its getter must be
+// wrapped with GenerationGetter to see the original keys again. The owner of a key loads it for whichever generation
+// its key carries, so values are only ever cached under the generation of the peer which asked for them, including
+// while peers are not in agreement yet.
+type Generations struct {
+    mu          sync.Mutex
+    epoch       string
+    generations map[string]int64 // keyed by group name
+}
+
+// NewGenerations creates Generations with every group at generation 0, in no epoch.
+func NewGenerations() *Generations {
+    return &Generations{generations: make(map[string]int64)}
+}
+
+// Set sets the epoch and the generations of groups within it, keyed by group name, e.g. as notified by
+// peerwatch.WatchGenerations. Within an epoch, generations only go forward: any lower than a group's current one are
+// ignored, so that values of old generations cannot be read again, e.g. when a stale copy of the generations is set
+// after a bump was. A new epoch replaces every generation, as keys of different epochs never collide. An empty epoch,
+// for generations which are not stored anywhere (any longer), is ignored once there is one.
+func (g *Generations) Set(epoch string, generations map[string]int64) {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    if epoch != g.epoch {
+        if epoch == "" {
+            return
+        }
+        g.epoch = epoch
+        g.generations = make(map[string]int64, len(generations))
+    }
+    for groupName, generation := range generations {
+        if generation > g.generations[groupName] {
+            g.generations[groupName] = generation
+        }
+    }
+}
+
+// Epoch returns the current epoch, "" if there is none yet.
+func (g *Generations) Epoch() string {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    return g.epoch
+}
+
+// Generation returns the current generation of the named group.
+func (g *Generations) Generation(groupName string) int64 {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    return g.generations[groupName]
+}
+
+// Key returns key mixed with the current epoch and generation of the named group, to get it from the group with.
+func (g *Generations) Key(groupName string, key string) string {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    generation := strconv.FormatInt(g.generations[groupName], 10)
+    if g.epoch == "" {
+        return generation + ":" + key
+    }
+    return g.epoch + "." + generation + ":" + key
+}
+
+// GenerationGetter wraps the getter of a group whose keys are mixed with their generation by Generations.Key, to call
+// getter with the original keys. Keys without a generation are passed on as they are.
+func GenerationGetter(getter groupcache.Getter) groupcache.Getter {
+    return groupcache.GetterFunc(func(ctx groupcache.Context, key string, dest groupcache.Sink) error {
+        if i := strings.IndexByte(key, ':'); i >= 0 {
+            generation := key[:i]
+            if j := strings.LastIndexByte(generation, '.'); j >= 0 {
+                generation = generation[j+1:]
+            }
+            if _, err := strconv.ParseInt(generation, 10, 64); err == nil {
+                key = key[i+1:]
+            }
+        }
+        return getter.Get(ctx, key, dest)
+    })
+}
@@ -0,0 +1,55 @@
+package ring_test
+
+import (
+    "testing"
+    "github.com/robwil/peer-aware-groupcache/groupcache"
+    "github.com/robwil/peer-aware-groupcache/ring"
+)
+
+func TestGenerationEpochs(t *testing.T) {
+    g := ring.NewGenerations()
+    if got, want := g.Key("primeFactors", "12345"), "0:12345"; got != want {
+        t.Errorf("key before any epoch = %q, want %q", got, want)
+    }
+
+    g.Set("5d0b6e2a", map[string]int64{"primeFactors": 3})
+    g.Set("5d0b6e2a", map[string]int64{"primeFactors": 2}) // stale
+    if got, want := g.Key("primeFactors", "12345"), "5d0b6e2a.3:12345"; got != want {
+        t.Errorf("key = %q, want %q as generations only go forward within an epoch", got, want)
+    }
+
+    g.Set("", nil) // the ConfigMap was deleted
+    if got, want := g.Key("primeFactors", "12345"), "5d0b6e2a.3:12345"; got != want {
+        t.Errorf("key once the ConfigMap is gone = %q, want %q", got, want)
+    }
+
+    g.Set("91c4f7e0", map[string]int64{"primeFactors": 1}) // and created again
+    if got, want := g.Key("primeFactors", "12345"), "91c4f7e0.1:12345"; got != want {
+        t.Errorf("key in a new epoch = %q, want %q", got, want)
+    }
+    if got := g.Generation("primeFactors"); got != 1 {
+        t.Errorf("generation in a new epoch = %d, want 1", got)
+    }
+}
+
+func TestGenerationGetter(t *testing.T) {
+    var got string
+    getter := ring.GenerationGetter(groupcache.GetterFunc(func(_ groupcache.Context, key string, dest groupcache.Sink) error {
+        got = key
+        return dest.SetString(key)
+    }))
+    for key, want := range map[string]string{
+        "3:12345":          "12345",
+        "5d0b6e2a.3:12345": "12345",
+        "12345":            "12345",
+        "a:b":              "a:b",
+    } {
+        var value string
+        if err := getter.Get(nil, key, groupcache.StringSink(&value)); err != nil {
+            t.Fatal(err)
+        }
+        if got != want {
+            t.Errorf("getter saw %q for key %q, want %q", got, key, want)
+        }
+    }
+}
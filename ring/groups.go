@@ -0,0 +1,58 @@
+package ring
+
+import (
+    "time"
+    "github.com/robwil/peer-aware-groupcache/groupcache"
+    "github.com/robwil/peer-aware-groupcache/peerbind"
+    "github.com/robwil/peer-aware-groupcache/peerwatch"
+)
+
+// GroupSpec declares a group along with where its peers come from and how its keys are spread over them,
+// so that e.g. heavy and light workloads can live on different subsets of pods within the same binary.
+type GroupSpec struct {
+    Name       string
+    CacheBytes int64
+    Getter     groupcache.Getter
+    // Source discovers the peers of the group.
+    Source peerwatch.Source
+    // Options configures the group's ring, e.g. its Strategy or Replicas. May be nil. The Strategy cannot track
+    // loads, as BoundedLoads does: the peers of a group serve its keys to each other, and would pass a key back to
+    // its owner as soon as the owner had fewer requests in flight from them than the average.
+    Options *Options
+    // PeerFallback is what the group does when loading a key from its peer fails. Defaults to
+    // groupcache.FallbackPopulate.
+    PeerFallback groupcache.PeerFallback
+    // HotKeys, if not nil, spreads the reads of the group's hot keys over several replicas (see HotKeys).
+    HotKeys *HotKeyOptions
+    // TTL is how long the group's values live once loaded, unless their getter sets otherwise (see
+    // groupcache.Group.SetTTL). Defaults to 0, for values which never expire.
+    TTL time.Duration
+}
+
+// NewGroup creates the group declared by spec, on a ring of its own (named after the group) which is kept up to
+// date with the peers discovered by spec.Source. peerURL turns a peer ip into its base URL, e.g. "http://10.0.0.2:5000".
+//
+// If the group's peers cannot be discovered, the group is still created, with the current pod as its only peer
+// until discovery recovers in the background (see peerbind.Bind), and the error is returned alongside it.
+// NewGroup panics if spec.Options has a Strategy tracking loads, such as BoundedLoads.
+func (r *Rings) NewGroup(spec GroupSpec, myIp string, peerURL func(ip string) string) (*groupcache.Group, error) {
+    if spec.Options != nil {
+        if _, ok := spec.Options.Strategy.(loadTracker); ok {
+            panic("ring: group " + spec.Name + " cannot spread its keys by load, as its peers serve each other")
+        }
+    }
+    pool := NewPool(peerURL(myIp), spec.Options)
+    r.Add(spec.Name, pool)
+    r.Bind(spec.Name, spec.Name)
+    if spec.HotKeys != nil {
+        r.SetPicker(spec.Name, NewHotKeys(pool, nil, spec.HotKeys))
+    }
+    binding, err := peerbind.Bind(spec.Name, spec.Source, pool, myIp, peerURL)
+    r.mu.Lock()
+    r.bindings = append(r.bindings, binding)
+    r.mu.Unlock()
+    group := groupcache.NewGroup(spec.Name, spec.CacheBytes, spec.Getter)
+    group.SetPeerFallback(spec.PeerFallback)
+    group.SetTTL(spec.TTL)
+    return group, err
+}
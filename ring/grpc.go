@@ -0,0 +1,146 @@
+package ring
+
+import (
+    "context"
+    "net"
+    "net/url"
+    "strconv"
+    "sync"
+    "github.com/robwil/peer-aware-groupcache/groupcache"
+    pb "github.com/golang/groupcache/groupcachepb"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+)
+
+// grpcGetMethod is the full name of the Get method of the GroupCache service in groupcache.proto.
+const grpcGetMethod = "/groupcachepb.GroupCache/Get"
+
+// groupCacheServer is the GroupCache service of groupcache.proto, which the generated groupcachepb package does not
+// include a server for.
+type groupCacheServer interface {
+    Get(ctx context.Context, in *pb.GetRequest) (*pb.GetResponse, error)
+}
+
+var groupCacheServiceDesc = grpc.ServiceDesc{
+    ServiceName: "groupcachepb.GroupCache",
+    HandlerType: (*groupCacheServer)(nil),
+    Methods: []grpc.MethodDesc{{
+        MethodName: "Get",
+        Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+            in := new(pb.GetRequest)
+            if err := dec(in); err != nil {
+                return nil, err
+            }
+            if interceptor == nil {
+                return srv.(groupCacheServer).Get(ctx, in)
+            }
+            info := &grpc.UnaryServerInfo{Server: srv, FullMethod: grpcGetMethod}
+            return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+                return srv.(groupCacheServer).Get(ctx, req.(*pb.GetRequest))
+            })
+        },
+    }},
+    Metadata: "groupcache.proto",
+}
+
+// grpcServer loads keys for peers, like Handler does for GET requests.
+type grpcServer struct{}
+
+func (grpcServer) Get(ctx context.Context, in *pb.GetRequest) (*pb.GetResponse, error) {
+    group := groupcache.GetGroup(in.GetGroup())
+    if group == nil {
+        return nil, status.Errorf(codes.NotFound, "no such group: %s", in.GetGroup())
+    }
+    group.Stats.ServerRequests.Add(1)
+    var value groupcache.ByteView
+    if err := group.Get(ctx, in.GetKey(), groupcache.ByteViewSink(&value)); err != nil {
+        if ctx.Err() != nil {
+            return nil, status.FromContextError(ctx.Err()).Err()
+        }
+        return nil, status.Error(codes.Unknown, err.Error())
+    }
+    return groupcache.NewGetResponse(value), nil
+}
+
+// RegisterGRPCServer serves groupcache requests from peers using GRPCGetters on s. As with Handler, requests name
+// their group, so a single server serves every Pool. The request's context (carrying its deadline) is passed to
+// Group.Get.
+func RegisterGRPCServer(s *grpc.Server) {
+    s.RegisterService(&groupCacheServiceDesc, grpcServer{})
+}
+
+// GRPCGetters loads keys from peers over gRPC, with a single long-lived, multiplexed connection per peer. Set it as
+// the Getters of a Pool whose peers serve RegisterGRPCServer.
+type GRPCGetters struct {
+    // Port is the port peers serve gRPC on, on the host of their base URL.
+    Port int
+    // Address optionally returns the gRPC address of the peer with the given base URL instead, e.g. for peers
+    // which do not share a port.
+    Address func(peer string) string
+    // DialOptions are passed to grpc.Dial. Defaults to an insecure connection.
+    DialOptions []grpc.DialOption
+
+    mu    sync.Mutex // guards conns
+    conns map[string]*grpc.ClientConn
+}
+
+func (g *GRPCGetters) address(peer string) string {
+    if g.Address != nil {
+        return g.Address(peer)
+    }
+    host := peer
+    if u, err := url.Parse(peer); err == nil && u.Hostname() != "" {
+        host = u.Hostname()
+    }
+    return net.JoinHostPort(host, strconv.Itoa(g.Port))
+}
+
+func (g *GRPCGetters) Getter(peer string) groupcache.ProtoGetter {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    if g.conns == nil {
+        g.conns = make(map[string]*grpc.ClientConn)
+    }
+    conn, ok := g.conns[peer]
+    if !ok {
+        opts := g.DialOptions
+        if opts == nil {
+            opts = []grpc.DialOption{grpc.WithInsecure()}
+        }
+        var err error
+        // Dial does not block, it connects (and reconnects) in the background
+        conn, err = grpc.Dial(g.address(peer), opts...)
+        if err != nil {
+            return grpcErrGetter{err}
+        }
+        g.conns[peer] = conn
+    }
+    return grpcGetter{conn}
+}
+
+func (g *GRPCGetters) Forget(peer string) {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    if conn, ok := g.conns[peer]; ok {
+        conn.Close()
+        delete(g.conns, peer)
+    }
+}
+
+type grpcGetter struct {
+    conn *grpc.ClientConn
+}
+
+func (g grpcGetter) Get(ctx groupcache.Context, in *pb.GetRequest, out *pb.GetResponse) error {
+    return g.conn.Invoke(RequestContext(ctx), grpcGetMethod, in, out)
+}
+
+// grpcErrGetter fails every request with the error of dialing its peer.
+type grpcErrGetter struct {
+    err error
+}
+
+func (g grpcErrGetter) Get(groupcache.Context, *pb.GetRequest, *pb.GetResponse) error {
+    return g.err
+}
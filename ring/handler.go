@@ -0,0 +1,129 @@
+package ring
+
+import (
+    "context"
+    "io/ioutil"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+    "github.com/robwil/peer-aware-groupcache/groupcache"
+    "github.com/golang/protobuf/proto"
+)
+
+// Handler serves groupcache requests from peers. Requests name their group, so a single Handler
+// serves every Pool sharing its BasePath.
+//
+// GET requests load a key, as with groupcache.HTTPPool, unless they carry a peek parameter, in which case only
+// a value already in the group's main cache is returned, and 404 otherwise (see Options.TransitionWindow). PUT requests hand off a key whose value a peer
+// had cached, storing the request body in the group's main cache until the time in the X-Groupcache-Expire
+// header, if any (see Rebalancer). DELETE requests remove a key from the group's caches, see Pool.Remove.
+// Responses to GET requests tell when their value expires, see groupcache.NewGetResponse. GET requests for HealthPath
+// answer 200 as long as the handler is being served, for Prober.
+type Handler struct {
+    // BasePath is the HTTP path the handler is mounted on. Defaults to DefaultBasePath.
+    BasePath string
+    // Context optionally creates the context passed to Group.Get for each request. Defaults to the request's
+    // context, which is canceled when the requesting peer gives up or its deadline passes, so that the key is not
+    // loaded once nobody wants it any more.
+    Context func(*http.Request) groupcache.Context
+    // AllowWrite decides whether to serve a PUT or DELETE request, which change what the group caches, once any handlers
+    // wrapping this one let it through. Defaults to refusing them all with 403, as anyone reaching the handler could
+    // otherwise write any key: set it to authenticate peers (e.g. with peerbind.Members.Allows), or to accept every
+    // request when the handler is only reachable by authenticated peers (e.g. behind peertls.RequireClientCert).
+    AllowWrite func(*http.Request) bool
+}
+
+// ExpireHeader carries when the value of a key handed off to a peer expires, in nanoseconds since the Unix epoch.
+const ExpireHeader = "X-Groupcache-Expire"
+
+func (h *Handler) basePath() string {
+    if h.BasePath == "" {
+        return DefaultBasePath
+    }
+    return h.BasePath
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    basePath := h.basePath()
+    if !strings.HasPrefix(r.URL.Path, basePath) {
+        http.Error(w, "bad request", http.StatusBadRequest)
+        return
+    }
+    if r.URL.Path[len(basePath):] == HealthPath {
+        w.Write([]byte("ok\n"))
+        return
+    }
+    parts := strings.SplitN(r.URL.Path[len(basePath):], "/", 2)
+    if len(parts) != 2 {
+        http.Error(w, "bad request", http.StatusBadRequest)
+        return
+    }
+    groupName := parts[0]
+    key := parts[1]
+
+    group := groupcache.GetGroup(groupName)
+    if group == nil {
+        http.Error(w, "no such group: "+groupName, http.StatusNotFound)
+        return
+    }
+    if r.Method == "PUT" {
+        if h.AllowWrite == nil || !h.AllowWrite(r) {
+            http.Error(w, "writes not allowed", http.StatusForbidden)
+            return
+        }
+        value, err := ioutil.ReadAll(r.Body)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        var expire time.Time
+        if nanos, err := strconv.ParseInt(r.Header.Get(ExpireHeader), 10, 64); err == nil {
+            expire = time.Unix(0, nanos)
+        }
+        group.Populate(key, value, expire)
+        w.WriteHeader(http.StatusNoContent)
+        return
+    }
+    if r.Method == "DELETE" {
+        if h.AllowWrite == nil || !h.AllowWrite(r) {
+            http.Error(w, "writes not allowed", http.StatusForbidden)
+            return
+        }
+        group.Remove(key)
+        w.WriteHeader(http.StatusNoContent)
+        return
+    }
+
+    if timeout, err := time.ParseDuration(r.Header.Get(TimeoutHeader)); err == nil {
+        reqCtx, cancel := context.WithTimeout(r.Context(), timeout)
+        defer cancel()
+        r = r.WithContext(reqCtx)
+    }
+    var ctx groupcache.Context = r.Context()
+    if h.Context != nil {
+        ctx = h.Context(r)
+    }
+
+    group.Stats.ServerRequests.Add(1)
+    var value groupcache.ByteView
+    if r.URL.Query().Get("peek") != "" {
+        cached, ok := group.Peek(key)
+        if !ok {
+            http.Error(w, "not cached: "+key, http.StatusNotFound)
+            return
+        }
+        value = cached
+    } else if err := group.Get(ctx, key, groupcache.ByteViewSink(&value)); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    body, err := proto.Marshal(groupcache.NewGetResponse(value))
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/x-protobuf")
+    w.Write(body)
+}
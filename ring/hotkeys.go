@@ -0,0 +1,128 @@
+package ring
+
+import (
+    "math/rand"
+    "time"
+    "github.com/robwil/peer-aware-groupcache/groupcache"
+)
+
+const (
+    defaultHotKeyReplicas  = 3
+    defaultHotKeyThreshold = 10
+    defaultHotKeyWindow    = 10 * time.Second
+)
+
+// HotKeyOptions configures HotKeys.
+type HotKeyOptions struct {
+    // Replicas is how many peers serve each hot key: its owner, and the Replicas-1 peers which would own it next.
+    // Defaults to 3.
+    Replicas int
+    // Threshold is how many times a key must be loaded from peers within Window to be hot. Defaults to 10.
+    Threshold int
+    // Window is the period over which loads of keys are counted. Defaults to 10 seconds.
+    Window time.Duration
+    // MaxKeys bounds how many keys are counted at once. Defaults to 10000.
+    MaxKeys int
+}
+
+// HotKeyStats are statistics on the hot keys of HotKeys.
+type HotKeyStats struct {
+    HotLoads     groupcache.AtomicInt // loads of keys which were hot at the time, spread over their replicas
+    ReplicaLoads groupcache.AtomicInt // loads of hot keys from a replica rather than their owner
+}
+
+// HotKeys is a groupcache.PeerPicker which spreads the reads of hot keys over several replicas, rather than only
+// their owner. A key is hot once the current peer loads it from peers Threshold times within Window (i.e. misses
+// it that often in its own caches). Each load of a hot key then goes to one of its replicas at random: its owner
+// and the next Replicas-1 peers along the ring. The replicas fetch the key from its owner, and keep it in their
+// hot cache (see groupcache.HotCachePicker), so the key is still only ever loaded by its owner.
+//
+// Replicas always fetch their keys from the owner, so that requests cannot go around in circles between replicas.
+// They count the keys they miss like any other peer, and only keep those which are hot by their own count, so that
+// keys which merely happen to have the current peer as a replica do not crowd its hot cache.
+//
+// Use Rings.SetPicker, or GroupSpec.HotKeys, to have the groups of a ring pick their peers through HotKeys.
+type HotKeys struct {
+    pool *Pool
+    next groupcache.PeerPicker
+    opts HotKeyOptions
+    hot  *keyCounts
+
+    Stats HotKeyStats
+}
+
+// NewHotKeys creates a HotKeys picking peers from pool, through next (e.g. a Breaker wrapping pool) if not nil.
+// Replicas other than the owner are picked directly from pool. opts may be nil to use the defaults.
+func NewHotKeys(pool *Pool, next groupcache.PeerPicker, opts *HotKeyOptions) *HotKeys {
+    h := &HotKeys{pool: pool, next: next}
+    if h.next == nil {
+        h.next = pool
+    }
+    if opts != nil {
+        h.opts = *opts
+    }
+    if h.opts.Replicas <= 0 {
+        h.opts.Replicas = defaultHotKeyReplicas
+    }
+    if h.opts.Threshold <= 0 {
+        h.opts.Threshold = defaultHotKeyThreshold
+    }
+    if h.opts.Window <= 0 {
+        h.opts.Window = defaultHotKeyWindow
+    }
+    h.hot = newKeyCounts(h.opts.Window, h.opts.MaxKeys)
+    return h
+}
+
+// Options returns the options of h, with defaults applied.
+func (h *HotKeys) Options() HotKeyOptions {
+    return h.opts
+}
+
+// isReplica returns whether the current peer is a replica of key, other than its owner, among replicas.
+func (h *HotKeys) isReplica(replicas []string) bool {
+    for _, peer := range replicas[1:] {
+        if peer == h.pool.Self() {
+            return true
+        }
+    }
+    return false
+}
+
+func (h *HotKeys) PickPeer(key string) (groupcache.ProtoGetter, bool) {
+    replicas := h.pool.Owners(key, h.opts.Replicas)
+    if len(replicas) == 0 || replicas[0] == h.pool.Self() {
+        return nil, false
+    }
+    if h.hot.add(key) < h.opts.Threshold || h.isReplica(replicas) {
+        return h.next.PickPeer(key)
+    }
+    h.Stats.HotLoads.Add(1)
+    if replica := replicas[rand.Intn(len(replicas))]; replica != replicas[0] {
+        if getter, ok := h.pool.getter(replica); ok {
+            h.Stats.ReplicaLoads.Add(1)
+            return getter, true
+        }
+    }
+    return h.next.PickPeer(key)
+}
+
+// PickPreviousPeer implements groupcache.PreviousPeerPicker, see Pool.PickPreviousPeer.
+func (h *HotKeys) PickPreviousPeer(key string) (groupcache.ProtoGetter, bool) {
+    if previous, ok := h.next.(groupcache.PreviousPeerPicker); ok {
+        return previous.PickPreviousPeer(key)
+    }
+    return h.pool.PickPreviousPeer(key)
+}
+
+// KeepHot implements groupcache.HotCachePicker: replicas keep the hot keys they fetch from the owner.
+func (h *HotKeys) KeepHot(key string) bool {
+    replicas := h.pool.Owners(key, h.opts.Replicas)
+    if len(replicas) > 0 && h.isReplica(replicas) && h.hot.count(key) >= h.opts.Threshold {
+        return true
+    }
+    if hot, ok := h.next.(groupcache.HotCachePicker); ok {
+        return hot.KeepHot(key)
+    }
+    return false
+}
@@ -0,0 +1,88 @@
+package ring_test
+
+import (
+    "fmt"
+    "testing"
+    "github.com/robwil/peer-aware-groupcache/groupcache"
+    pb "github.com/golang/groupcache/groupcachepb"
+    "github.com/robwil/peer-aware-groupcache/ring"
+)
+
+// countingPicker stands for the picker HotKeys wraps, counting the keys it is asked to pick.
+type countingPicker struct {
+    picks int
+}
+
+func (p *countingPicker) PickPeer(key string) (groupcache.ProtoGetter, bool) {
+    p.picks++
+    return nopGetter{}, true
+}
+
+// nopGetter is a peer answering every request with an empty value.
+type nopGetter struct{}
+
+func (nopGetter) Get(groupcache.Context, *pb.GetRequest, *pb.GetResponse) error {
+    return nil
+}
+
+// keyWhere returns a key whose replicas in pool match.
+func keyWhere(t *testing.T, pool *ring.Pool, replicas int, match func(replicas []string) bool) string {
+    for i := 0; i < 10000; i++ {
+        if key := fmt.Sprint("key-", i); match(pool.Owners(key, replicas)) {
+            return key
+        }
+    }
+    t.Fatal("no key matches")
+    return ""
+}
+
+func TestHotKeys(t *testing.T) {
+    const self = "http://self"
+    pool := ring.NewPool(self, nil)
+    pool.Set(self, "http://10.0.0.1:5000", "http://10.0.0.2:5000", "http://10.0.0.3:5000", "http://10.0.0.4:5000")
+    next := &countingPicker{}
+    opts := &ring.HotKeyOptions{Replicas: 3, Threshold: 5}
+    h := ring.NewHotKeys(pool, next, opts)
+
+    key := keyWhere(t, pool, 3, func(replicas []string) bool {
+        return replicas[0] != self && replicas[1] != self && replicas[2] != self
+    })
+    for i := 1; i < opts.Threshold; i++ {
+        h.PickPeer(key)
+    }
+    if next.picks != opts.Threshold-1 || h.Stats.HotLoads.Get() != 0 {
+        t.Fatalf("%d of %d loads of a key which is not hot yet went to its owner, want all", next.picks, opts.Threshold-1)
+    }
+    const loads = 300
+    next.picks = 0
+    for i := 0; i < loads; i++ {
+        if _, ok := h.PickPeer(key); !ok {
+            t.Fatalf("no peer picked for a hot key")
+        }
+    }
+    if h.Stats.HotLoads.Get() != loads || h.Stats.ReplicaLoads.Get() == 0 || next.picks+int(h.Stats.ReplicaLoads.Get()) != loads {
+        t.Errorf("%d hot loads, %d from replicas and %d from the owner, want %d spread over the replicas",
+            h.Stats.HotLoads.Get(), h.Stats.ReplicaLoads.Get(), next.picks, loads)
+    }
+    if h.KeepHot(key) {
+        t.Errorf("hot key kept by a peer which is not one of its replicas")
+    }
+
+    // a replica fetches hot keys from their owner, and keeps them
+    replicated := keyWhere(t, pool, 3, func(replicas []string) bool { return replicas[1] == self })
+    next.picks = 0
+    for i := 0; i < 2*opts.Threshold; i++ {
+        h.PickPeer(replicated)
+    }
+    if next.picks != 2*opts.Threshold {
+        t.Errorf("%d of %d loads from a replica went to the owner, want all", next.picks, 2*opts.Threshold)
+    }
+    if !h.KeepHot(replicated) {
+        t.Errorf("hot key not kept by its replica")
+    }
+
+    owned := keyWhere(t, pool, 3, func(replicas []string) bool { return replicas[0] == self })
+    if _, ok := h.PickPeer(owned); ok {
+        t.Errorf("peer picked for a key the current peer owns")
+    }
+}
@@ -0,0 +1,66 @@
+package ring
+
+import (
+    "sync"
+    "time"
+)
+
+// defaultKeyCountsMax bounds how many keys a keyCounts counts at once.
+const defaultKeyCountsMax = 10000
+
+// keyCounts counts the loads of keys over a sliding window, to tell which keys are hot. The window is made of two
+// halves: counts start over in a new half every window/2, and a key's count is that of both halves.
+//
+// Only max keys are counted in each half, so that a scan over many keys cannot use up memory; keys beyond that
+// are not counted until the next half.
+type keyCounts struct {
+    window time.Duration
+    max    int
+
+    mu       sync.Mutex // guards everything below
+    current  map[string]int
+    previous map[string]int
+    started  time.Time // of the current half
+}
+
+func newKeyCounts(window time.Duration, max int) *keyCounts {
+    if max <= 0 {
+        max = defaultKeyCountsMax
+    }
+    return &keyCounts{window: window, max: max, current: make(map[string]int), started: time.Now()}
+}
+
+// rotate starts a new half if the current one is over. mu must be held.
+func (h *keyCounts) rotate() {
+    now := time.Now()
+    elapsed := now.Sub(h.started)
+    if elapsed < h.window/2 {
+        return
+    }
+    if elapsed < h.window {
+        h.previous = h.current
+    } else {
+        h.previous = nil // nothing was counted during the last half
+    }
+    h.current = make(map[string]int)
+    h.started = now
+}
+
+// add counts a load of key, returning its count over the window.
+func (h *keyCounts) add(key string) int {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    h.rotate()
+    if _, ok := h.current[key]; ok || len(h.current) < h.max {
+        h.current[key]++
+    }
+    return h.current[key] + h.previous[key]
+}
+
+// count returns the count of key over the window.
+func (h *keyCounts) count(key string) int {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    h.rotate()
+    return h.current[key] + h.previous[key]
+}
@@ -0,0 +1,423 @@
+package ring
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "sync"
+    "time"
+    "github.com/robwil/peer-aware-groupcache/groupcache"
+    "github.com/golang/groupcache/consistenthash"
+    pb "github.com/golang/groupcache/groupcachepb"
+    "github.com/golang/protobuf/proto"
+)
+
+const (
+    DefaultBasePath = "/_groupcache/"
+    defaultReplicas = 50
+)
+
+// Options configures a Pool. They mirror groupcache.HTTPPoolOptions.
+type Options struct {
+    // BasePath is the HTTP path peers serve groupcache requests on. Defaults to DefaultBasePath.
+    BasePath string
+    // Replicas is the number of key replicas on the consistent hash. Defaults to 50.
+    Replicas int
+    // HashFn is the hash function of the consistent hash. Defaults to crc32.ChecksumIEEE.
+    HashFn consistenthash.Hash
+    // Strategy decides how keys are spread over the peers, e.g. Rendezvous. Defaults to Consistent, with Replicas
+    // and HashFn.
+    Strategy Strategy
+    // Transport optionally specifies an http.RoundTripper to fetch from peers with. Defaults to http.DefaultTransport.
+    // Requests carry the values of the context passed to Group.Get when it is a context.Context, but not its deadline
+    // or cancelation, as every caller getting the key at the time shares the request.
+    Transport func(groupcache.Context) http.RoundTripper
+    // PeerTimeout bounds each request to a peer. Defaults to 0, for no timeout.
+    PeerTimeout time.Duration
+    // Getters optionally creates the getters which keys are loaded from peers with, for transports other than
+    // HTTP (e.g. GRPCGetters). Requests to peers for anything else (e.g. PUT and peek requests) still use HTTP.
+    // Defaults to loading over HTTP with Transport.
+    Getters Getters
+    // TransitionWindow is how long the ring from before the peers last changed is kept around. Within it, a key
+    // missing from its new owner is first fetched from the cache of its previous owner, if that is still a peer,
+    // before loading it. Defaults to 0, which disables this.
+    TransitionWindow time.Duration
+}
+
+// Getters creates the getters which a Pool loads keys from its peers with.
+type Getters interface {
+    // Getter returns the getter of the peer with the given base URL, e.g. "http://10.0.0.2:5000".
+    Getter(peer string) groupcache.ProtoGetter
+    // Forget releases anything held for a peer which is no longer part of the pool.
+    Forget(peer string)
+}
+
+// Pool is a ring of HTTP peers implementing groupcache.PeerPicker, much like groupcache.HTTPPool.
+// Unlike HTTPPool, any number of Pools can exist in one process (e.g. one per shard), and creating one
+// registers nothing: use Rings to bind groups to pools, and Handler to serve requests from peers.
+type Pool struct {
+    self string
+    opts Options
+
+    mu          sync.Mutex // guards urls, weights, peers, getters, peekers, stats, previous, previousUntil and subscribers
+    urls        []string
+    weights     map[string]float64 // relative shares of keys, keyed by peer base URL; nil if all peers weigh 1
+    peers       Hash
+    getters     map[string]*peerGetter // keyed by peer base URL, e.g. "http://10.0.0.2:5000"
+    peekers     map[string]*peerGetter // like getters, but only asking for cached values
+    stats       map[string]*PeerStats  // of the current peers, kept across Set
+    subscribers []func(previous []string, current []string)
+
+    // previous is the ring from before the current transition, which ends at previousUntil.
+    previous      Hash
+    previousUntil time.Time
+}
+
+// NewPool creates an empty Pool. self is the base URL of the current peer, e.g. "http://10.0.0.1:5000".
+// opts may be nil to use the defaults.
+func NewPool(self string, opts *Options) *Pool {
+    p := &Pool{self: self}
+    if opts != nil {
+        p.opts = *opts
+    }
+    if p.opts.BasePath == "" {
+        p.opts.BasePath = DefaultBasePath
+    }
+    if p.opts.Replicas == 0 {
+        p.opts.Replicas = defaultReplicas
+    }
+    if p.opts.Strategy == nil {
+        p.opts.Strategy = Consistent{Replicas: p.opts.Replicas, HashFn: p.opts.HashFn}
+    }
+    p.peers = p.hash(nil, nil)
+    p.getters = make(map[string]*peerGetter)
+    p.peekers = make(map[string]*peerGetter)
+    p.stats = make(map[string]*PeerStats)
+    return p
+}
+
+// Set replaces the pool's peers. Each peer is a base URL, e.g. "http://10.0.0.2:5000".
+func (p *Pool) Set(peers ...string) {
+    p.mu.Lock()
+    previous := p.urls
+    p.startTransition()
+    p.urls = append([]string(nil), peers...)
+    p.peers = p.hash(peers, p.weights)
+    p.getters = make(map[string]*peerGetter, len(peers))
+    p.peekers = make(map[string]*peerGetter, len(peers))
+    stats := make(map[string]*PeerStats, len(peers))
+    for _, peer := range peers {
+        stats[peer] = p.stats[peer]
+        if stats[peer] == nil {
+            stats[peer] = &PeerStats{}
+        }
+        var getter groupcache.ProtoGetter = &httpGetter{transport: p.opts.Transport, baseURL: peer + p.opts.BasePath}
+        if p.opts.Getters != nil {
+            getter = p.opts.Getters.Getter(peer)
+        }
+        p.getters[peer] = &peerGetter{getter: getter, timeout: p.opts.PeerTimeout, stats: stats[peer]}
+        if loads, ok := p.opts.Strategy.(loadTracker); ok {
+            p.getters[peer].loads, p.getters[peer].peer = loads, peer
+        }
+        peeker := &httpGetter{transport: p.opts.Transport, baseURL: peer + p.opts.BasePath, peek: true}
+        p.peekers[peer] = &peerGetter{getter: peeker, timeout: p.opts.PeerTimeout}
+    }
+    if p.opts.Getters != nil {
+        for peer := range p.stats {
+            if stats[peer] == nil {
+                p.opts.Getters.Forget(peer)
+            }
+        }
+    }
+    p.stats = stats
+    subscribers := p.subscribers
+    p.mu.Unlock()
+
+    for _, fn := range subscribers {
+        fn(previous, peers)
+    }
+}
+
+// SetWeights sets the relative shares of keys of peers, keyed by base URL, if the pool's Strategy supports weights
+// (see WeightedStrategy). Peers missing from weights weigh 1. Like Set, changing weights moves keys between peers,
+// and so starts a transition and notifies subscribers, with unchanged peers.
+func (p *Pool) SetWeights(weights map[string]float64) {
+    p.mu.Lock()
+    if equalWeights(p.weights, weights) {
+        p.mu.Unlock()
+        return
+    }
+    p.weights = make(map[string]float64, len(weights))
+    for peer, w := range weights {
+        p.weights[peer] = w
+    }
+    p.startTransition()
+    p.peers = p.hash(p.urls, p.weights)
+    peers := append([]string(nil), p.urls...)
+    subscribers := p.subscribers
+    p.mu.Unlock()
+
+    for _, fn := range subscribers {
+        fn(peers, peers)
+    }
+}
+
+// Weights returns the weights set with SetWeights.
+func (p *Pool) Weights() map[string]float64 {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    weights := make(map[string]float64, len(p.weights))
+    for peer, w := range p.weights {
+        weights[peer] = w
+    }
+    return weights
+}
+
+func equalWeights(a map[string]float64, b map[string]float64) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for peer, w := range a {
+        if bw, ok := b[peer]; !ok || bw != w {
+            return false
+        }
+    }
+    return true
+}
+
+// startTransition keeps the current ring as the previous one, before it changes. mu must be held.
+func (p *Pool) startTransition() {
+    if p.opts.TransitionWindow <= 0 {
+        return
+    }
+    // a burst of changes (e.g. a rolling deploy) is a single transition, away from the ring before the first one
+    now := time.Now()
+    if p.previous == nil || now.After(p.previousUntil) {
+        p.previous = p.peers
+    }
+    p.previousUntil = now.Add(p.opts.TransitionWindow)
+}
+
+// hash builds the Hash of the given peers with the pool's Strategy, weighted if it supports weights.
+func (p *Pool) hash(peers []string, weights map[string]float64) Hash {
+    if weighted, ok := p.opts.Strategy.(WeightedStrategy); ok && len(weights) > 0 {
+        return weighted.WeightedHash(peers, weights)
+    }
+    return p.opts.Strategy.Hash(peers)
+}
+
+// newHash builds the Hash of the given peers, with the pool's Strategy and current weights. mu must not be held.
+func (p *Pool) newHash(peers []string) Hash {
+    p.mu.Lock()
+    weights := p.weights
+    p.mu.Unlock()
+    return p.hash(peers, weights)
+}
+
+// currentHash returns the Hash of the current peers.
+func (p *Pool) currentHash() Hash {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return p.peers
+}
+
+// Subscribe calls fn with the previous and current peers after every Set.
+func (p *Pool) Subscribe(fn func(previous []string, current []string)) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    p.subscribers = append(p.subscribers, fn)
+}
+
+// Self returns the base URL of the current peer.
+func (p *Pool) Self() string {
+    return p.self
+}
+
+// Owner returns the base URL of the peer owning key, which may be Self, or "" if the pool has no peers.
+func (p *Pool) Owner(key string) string {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return p.peers.Get(key)
+}
+
+// Owners returns the base URLs of the owner of key followed by up to n-1 other peers, in the order they would own
+// key if the peers before them were gone (see Hash.GetN).
+func (p *Pool) Owners(key string, n int) []string {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return p.peers.GetN(key, n)
+}
+
+// Peers returns the pool's current peers.
+func (p *Pool) Peers() []string {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return append([]string(nil), p.urls...)
+}
+
+// getter returns the getter of a current peer.
+func (p *Pool) getter(peer string) (*peerGetter, bool) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    getter, ok := p.getters[peer]
+    return getter, ok
+}
+
+// PeerStats returns the statistics of requests to each current peer, keyed by base URL.
+func (p *Pool) PeerStats() map[string]*PeerStats {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    stats := make(map[string]*PeerStats, len(p.stats))
+    for peer, s := range p.stats {
+        stats[peer] = s
+    }
+    return stats
+}
+
+// PeerStats are statistics on the requests to load keys from one peer. Requests abandoned by their caller are
+// not counted.
+type PeerStats struct {
+    Requests groupcache.AtomicInt
+    Errors   groupcache.AtomicInt // including timeouts
+}
+
+// FailureRate returns the fraction of requests to the peer which failed.
+func (s *PeerStats) FailureRate() float64 {
+    requests := s.Requests.Get()
+    if requests == 0 {
+        return 0
+    }
+    return float64(s.Errors.Get()) / float64(requests)
+}
+
+func (p *Pool) PickPeer(key string) (groupcache.ProtoGetter, bool) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if p.peers.IsEmpty() {
+        return nil, false
+    }
+    if peer := p.peers.Get(key); peer != p.self {
+        return p.getters[peer], true
+    }
+    return nil, false
+}
+
+// PickPreviousPeer implements groupcache.PreviousPeerPicker, for keys owned by the current peer. Within the
+// TransitionWindow, it picks the key's owner in the previous ring if that is another peer still in the pool, asking
+// it for its cached value only.
+func (p *Pool) PickPreviousPeer(key string) (groupcache.ProtoGetter, bool) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if p.previous == nil || p.previous.IsEmpty() || time.Now().After(p.previousUntil) {
+        return nil, false
+    }
+    peer := p.previous.Get(key)
+    if peer == p.self {
+        return nil, false
+    }
+    peeker, ok := p.peekers[peer]
+    return peeker, ok
+}
+
+// loadTracker is implemented by Strategies which spread keys by the load of peers, such as BoundedLoads.
+type loadTracker interface {
+    Acquire(peer string)
+    Release(peer string)
+}
+
+// peerGetter applies the timeout of a pool to the requests of a getter, and counts them in stats (and in loads,
+// if the pool's Strategy tracks them).
+type peerGetter struct {
+    getter  groupcache.ProtoGetter
+    timeout time.Duration
+    stats   *PeerStats // nil for peeks, whose misses are not failures
+    loads   loadTracker
+    peer    string
+}
+
+func (g *peerGetter) Get(ctx groupcache.Context, in *pb.GetRequest, out *pb.GetResponse) error {
+    if g.loads != nil {
+        g.loads.Acquire(g.peer)
+        defer g.loads.Release(g.peer)
+    }
+    var err error
+    if g.timeout > 0 {
+        reqCtx, cancel := context.WithTimeout(RequestContext(ctx), g.timeout)
+        err = g.getter.Get(reqCtx, in, out)
+        cancel()
+    } else {
+        err = g.getter.Get(ctx, in, out)
+    }
+    if g.stats != nil && RequestContext(ctx).Err() == nil {
+        g.stats.Requests.Add(1)
+        if err != nil {
+            g.stats.Errors.Add(1)
+        }
+    }
+    return err
+}
+
+type httpGetter struct {
+    transport func(groupcache.Context) http.RoundTripper
+    baseURL   string
+    peek      bool // only ask for cached values, see Handler
+}
+
+// TimeoutHeader carries the time left until the deadline of a request to a peer, so that the peer does not start
+// loading the key once its result is no longer wanted.
+const TimeoutHeader = "X-Groupcache-Timeout"
+
+// RequestContext returns ctx if it is a context.Context, and context.Background otherwise. Loads from peers, and
+// the requests they serve through Handler, pass their context.Context to Group.Get, so getters and transports can
+// use its values. Group.Get does not start loading keys once that context is done.
+func RequestContext(ctx groupcache.Context) context.Context {
+    if c, ok := ctx.(context.Context); ok && c != nil {
+        return c
+    }
+    return context.Background()
+}
+
+var bufferPool = sync.Pool{
+    New: func() interface{} { return new(bytes.Buffer) },
+}
+
+func (h *httpGetter) Get(ctx groupcache.Context, in *pb.GetRequest, out *pb.GetResponse) error {
+    u := fmt.Sprintf("%v%v/%v", h.baseURL, url.QueryEscape(in.GetGroup()), url.QueryEscape(in.GetKey()))
+    if h.peek {
+        u += "?peek=1"
+    }
+    req, err := http.NewRequest("GET", u, nil)
+    if err != nil {
+        return err
+    }
+    reqCtx := RequestContext(ctx)
+    if deadline, ok := reqCtx.Deadline(); ok {
+        req.Header.Set(TimeoutHeader, time.Until(deadline).String())
+    }
+    req = req.WithContext(reqCtx)
+    tr := http.DefaultTransport
+    if h.transport != nil {
+        tr = h.transport(ctx)
+    }
+    res, err := tr.RoundTrip(req)
+    if err != nil {
+        return err
+    }
+    defer res.Body.Close()
+    if res.StatusCode != http.StatusOK {
+        return fmt.Errorf("server returned: %v", res.Status)
+    }
+    b := bufferPool.Get().(*bytes.Buffer)
+    b.Reset()
+    defer bufferPool.Put(b)
+    if _, err := io.Copy(b, res.Body); err != nil {
+        return fmt.Errorf("reading response body: %v", err)
+    }
+    if err := proto.Unmarshal(b.Bytes(), out); err != nil {
+        return fmt.Errorf("decoding response body: %v", err)
+    }
+    return nil
+}
@@ -0,0 +1,179 @@
+package ring
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "net/http"
+    "sort"
+    "sync"
+    "time"
+    "github.com/robwil/peer-aware-groupcache/groupcache"
+)
+
+// HealthPath is the path, relative to a Handler's BasePath, on which peers answer health probes.
+const HealthPath = "_health"
+
+const (
+    defaultProbeInterval = 5 * time.Second
+    defaultProbeTimeout  = 1 * time.Second
+    defaultProbeFailures = 2
+)
+
+// ProbeOptions configures a Prober.
+type ProbeOptions struct {
+    // Interval is how often every peer is probed. Defaults to 5 seconds.
+    Interval time.Duration
+    // Timeout bounds each probe. Defaults to 1 second.
+    Timeout time.Duration
+    // Failures is how many probes of a peer in a row must fail before it is considered unreachable. A single
+    // successful probe makes it reachable again. Defaults to 2.
+    Failures int
+}
+
+// ProbeStats are statistics on the probes of a Prober.
+type ProbeStats struct {
+    Probes        groupcache.AtomicInt
+    ProbeFailures groupcache.AtomicInt
+    Unreachable   groupcache.AtomicInt // times a peer became unreachable
+}
+
+// Prober periodically probes the HealthPath of every peer of a Pool over the pool's transport, to find peers which
+// Kubernetes considers ready but which the current peer cannot reach (e.g. network partitions or NetworkPolicy
+// mistakes). Whenever a peer becomes unreachable or reachable again it calls its notify function, such as
+// Breaker.SetReachable to route around unreachable peers.
+type Prober struct {
+    pool   *Pool
+    opts   ProbeOptions
+    client *http.Client
+    notify func(peer string, reachable bool)
+
+    mu       sync.Mutex     // guards failures
+    failures map[string]int // consecutive failed probes, keyed by peer base URL
+
+    Stats ProbeStats
+}
+
+// NewProber starts probing the peers of pool. notify may be nil. opts may be nil to use the defaults.
+func NewProber(pool *Pool, opts *ProbeOptions, notify func(peer string, reachable bool)) *Prober {
+    p := &Prober{pool: pool, notify: notify, failures: make(map[string]int)}
+    if opts != nil {
+        p.opts = *opts
+    }
+    if p.opts.Interval <= 0 {
+        p.opts.Interval = defaultProbeInterval
+    }
+    if p.opts.Timeout <= 0 {
+        p.opts.Timeout = defaultProbeTimeout
+    }
+    if p.opts.Failures <= 0 {
+        p.opts.Failures = defaultProbeFailures
+    }
+    transport := http.DefaultTransport
+    if pool.opts.Transport != nil {
+        transport = pool.opts.Transport(nil)
+    }
+    p.client = &http.Client{Transport: transport, Timeout: p.opts.Timeout}
+    go p.run()
+    return p
+}
+
+func (p *Prober) run() {
+    ticker := time.NewTicker(p.opts.Interval)
+    defer ticker.Stop()
+    for range ticker.C {
+        p.probeAll()
+    }
+}
+
+// probeAll probes every peer other than the current one concurrently, and forgets about peers which left.
+func (p *Prober) probeAll() {
+    self := p.pool.Self()
+    peers := make(map[string]bool)
+    var wg sync.WaitGroup
+    for _, peer := range p.pool.Peers() {
+        if peer == self {
+            continue
+        }
+        peers[peer] = true
+        wg.Add(1)
+        go func(peer string) {
+            defer wg.Done()
+            p.probe(peer)
+        }(peer)
+    }
+    wg.Wait()
+
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    for peer := range p.failures {
+        if !peers[peer] {
+            delete(p.failures, peer)
+        }
+    }
+}
+
+func (p *Prober) probe(peer string) {
+    p.Stats.Probes.Add(1)
+    err := p.get(peer + p.pool.opts.BasePath + HealthPath)
+    if err != nil {
+        p.Stats.ProbeFailures.Add(1)
+    }
+
+    p.mu.Lock()
+    failures := p.failures[peer]
+    if err == nil {
+        p.failures[peer] = 0
+    } else {
+        p.failures[peer] = failures + 1
+    }
+    p.mu.Unlock()
+
+    switch {
+    case err != nil && failures+1 == p.opts.Failures:
+        log.Printf("WARNING: peer %s is unreachable: %v", peer, err)
+        p.Stats.Unreachable.Add(1)
+        p.setReachable(peer, false)
+    case err == nil && failures >= p.opts.Failures:
+        log.Printf("Peer %s is reachable again", peer)
+        p.setReachable(peer, true)
+    }
+}
+
+func (p *Prober) get(u string) error {
+    req, err := http.NewRequest("GET", u, nil)
+    if err != nil {
+        return err
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), p.opts.Timeout)
+    defer cancel()
+    res, err := p.client.Do(req.WithContext(ctx))
+    if err != nil {
+        return err
+    }
+    res.Body.Close()
+    if res.StatusCode != http.StatusOK {
+        return fmt.Errorf("server returned: %v", res.Status)
+    }
+    return nil
+}
+
+func (p *Prober) setReachable(peer string, reachable bool) {
+    if p.notify != nil {
+        p.notify(peer, reachable)
+    }
+}
+
+// Unreachable returns the peers currently considered unreachable, sorted.
+func (p *Prober) Unreachable() []string {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    var peers []string
+    for peer, failures := range p.failures {
+        if failures >= p.opts.Failures {
+            peers = append(peers, peer)
+        }
+    }
+    sort.Strings(peers)
+    return peers
+}
@@ -0,0 +1,237 @@
+package ring
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "log"
+    "net/http"
+    "net/url"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+    "github.com/robwil/peer-aware-groupcache/groupcache"
+    "golang.org/x/time/rate"
+)
+
+const (
+    defaultRebalanceBytesPerSecond = 1 << 20
+    defaultRebalanceDelay          = 5 * time.Second
+    rebalancePushTimeout           = 10 * time.Second
+)
+
+// RebalanceOptions configures a Rebalancer.
+type RebalanceOptions struct {
+    // BytesPerSecond limits how fast values are pushed to their new owners. Defaults to 1MB/s.
+    // Values larger than this are never pushed.
+    BytesPerSecond int
+    // Delay is how long to wait after the ring changes before rebalancing, so that a burst of changes
+    // (e.g. a rolling deploy) only causes one rebalance. Defaults to 5 seconds.
+    Delay time.Duration
+}
+
+// RebalanceStats are statistics on the keys handed off by a Rebalancer.
+type RebalanceStats struct {
+    Runs        groupcache.AtomicInt // rebalances after a ring change
+    Drains      groupcache.AtomicInt // hand-offs before shutting down
+    KeysPushed  groupcache.AtomicInt
+    BytesPushed groupcache.AtomicInt // of values pushed
+    KeysSkipped groupcache.AtomicInt // values too large to push
+    PushErrors  groupcache.AtomicInt
+}
+
+// Rebalancer hands keys off to their new owners when the ring changes, so that newly assigned owners do not
+// start out with cold caches. After every change it goes through the main cache of its groups, and pushes each
+// key which this peer owned before the change, but no longer does, to its new owner. See also Drain.
+type Rebalancer struct {
+    pool    *Pool
+    groups  []*groupcache.Group
+    opts    RebalanceOptions
+    limiter *rate.Limiter
+    client  *http.Client
+
+    mu       sync.Mutex // guards previous and pending
+    previous Hash       // ring as of the last rebalance
+    pending  bool
+
+    running chan struct{}      // holds a token while rebalancing or draining, serializing them
+    ctx     context.Context    // of rebalances, done once draining
+    stop    context.CancelFunc // cancels ctx
+
+    Stats RebalanceStats
+}
+
+// NewRebalancer starts handing off the keys of groups whenever pool's peers change. The groups must use pool
+// to pick their peers, and pool's Strategy must give each key the same owner whatever the load, unlike
+// BoundedLoads. opts may be nil to use the defaults.
+func NewRebalancer(pool *Pool, groups []*groupcache.Group, opts *RebalanceOptions) *Rebalancer {
+    r := &Rebalancer{pool: pool, groups: groups, running: make(chan struct{}, 1)}
+    r.ctx, r.stop = context.WithCancel(context.Background())
+    if opts != nil {
+        r.opts = *opts
+    }
+    if r.opts.BytesPerSecond <= 0 {
+        r.opts.BytesPerSecond = defaultRebalanceBytesPerSecond
+    }
+    if r.opts.Delay <= 0 {
+        r.opts.Delay = defaultRebalanceDelay
+    }
+    r.limiter = rate.NewLimiter(rate.Limit(r.opts.BytesPerSecond), r.opts.BytesPerSecond)
+    transport := http.DefaultTransport
+    if pool.opts.Transport != nil {
+        transport = pool.opts.Transport(nil)
+    }
+    r.client = &http.Client{Transport: transport, Timeout: rebalancePushTimeout}
+    r.previous = pool.currentHash()
+    pool.Subscribe(r.changed)
+    return r
+}
+
+func (r *Rebalancer) changed(_ []string, _ []string) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if r.pending {
+        return
+    }
+    r.pending = true
+    time.AfterFunc(r.opts.Delay, r.run)
+}
+
+func (r *Rebalancer) run() {
+    select {
+    case r.running <- struct{}{}:
+        defer func() { <-r.running }()
+    case <-r.ctx.Done():
+        return // draining already
+    }
+
+    r.mu.Lock()
+    r.pending = false
+    previous := r.previous
+    r.previous = r.pool.currentHash()
+    r.mu.Unlock()
+
+    r.Stats.Runs.Add(1)
+    self := r.pool.Self()
+    pushed := 0
+    for _, group := range r.groups {
+        for _, key := range group.MainCacheKeys() {
+            if r.ctx.Err() != nil {
+                log.Printf("Rebalance interrupted by draining: handed off %d keys to their new owners", pushed)
+                return
+            }
+            if previous.IsEmpty() || previous.Get(key) != self {
+                continue
+            }
+            owner := r.pool.Owner(key)
+            if owner == "" || owner == self {
+                continue
+            }
+            value, ok := group.Peek(key)
+            if !ok {
+                continue // evicted in the meantime
+            }
+            if r.push(r.ctx, owner, group.Name(), key, value, true) {
+                pushed++
+            }
+        }
+    }
+    log.Printf("Rebalanced: handed off %d keys to their new owners", pushed)
+}
+
+// Drain hands off the most valuable keys of every group to the peers which will own them once this peer is
+// gone, for when it is about to shut down. Keys are pushed by descending hit count (most recently used first
+// among equal counts) until there are none left or ctx is done; the rate limit does not apply, ctx alone bounds
+// how long draining takes. Any rebalance in progress is interrupted, and none is started afterwards. It returns
+// the number of keys handed off.
+func (r *Rebalancer) Drain(ctx context.Context) int {
+    r.stop()
+    select {
+    case r.running <- struct{}{}:
+        defer func() { <-r.running }()
+    case <-ctx.Done():
+        log.Printf("WARNING: gave up draining, waiting for a rebalance to stop: %v", ctx.Err())
+        return 0
+    }
+
+    self := r.pool.Self()
+    var others []string
+    for _, peer := range r.pool.Peers() {
+        if peer != self {
+            others = append(others, peer)
+        }
+    }
+    if len(others) == 0 {
+        return 0
+    }
+    remaining := r.pool.newHash(others)
+
+    type drainEntry struct {
+        groupName string
+        groupcache.CacheEntry
+    }
+    var entries []drainEntry
+    for _, group := range r.groups {
+        for _, entry := range group.MainCacheEntries() {
+            entries = append(entries, drainEntry{group.Name(), entry})
+        }
+    }
+    // entries of each group are most recently used first, which a stable sort preserves among equal hit counts
+    sort.SliceStable(entries, func(i, j int) bool { return entries[i].Hits > entries[j].Hits })
+
+    r.Stats.Drains.Add(1)
+    pushed := 0
+    for _, entry := range entries {
+        if ctx.Err() != nil {
+            break
+        }
+        if r.push(ctx, remaining.Get(entry.Key), entry.groupName, entry.Key, entry.Value, false) {
+            pushed++
+        }
+    }
+    log.Printf("Drained: handed off %d of %d keys before shutting down", pushed, len(entries))
+    return pushed
+}
+
+// push hands off one key to its new owner, along with when it expires, waiting for the rate limit first if limited
+// is set.
+func (r *Rebalancer) push(ctx context.Context, owner string, groupName string, key string, view groupcache.ByteView, limited bool) bool {
+    value := view.ByteSlice()
+    if limited {
+        if len(value) > r.opts.BytesPerSecond {
+            r.Stats.KeysSkipped.Add(1)
+            return false
+        }
+        if err := r.limiter.WaitN(ctx, len(value)); err != nil {
+            r.Stats.KeysSkipped.Add(1)
+            return false
+        }
+    }
+
+    u := fmt.Sprintf("%v%v%v/%v", owner, r.pool.opts.BasePath, url.QueryEscape(groupName), url.QueryEscape(key))
+    req, err := http.NewRequest("PUT", u, bytes.NewReader(value))
+    if err != nil {
+        r.Stats.PushErrors.Add(1)
+        return false
+    }
+    if expire := view.Expire(); !expire.IsZero() {
+        req.Header.Set(ExpireHeader, strconv.FormatInt(expire.UnixNano(), 10))
+    }
+    req = req.WithContext(ctx)
+    res, err := r.client.Do(req)
+    if err != nil {
+        r.Stats.PushErrors.Add(1)
+        log.Printf("WARNING: error handing off %s/%s to %s: %v", groupName, key, owner, err)
+        return false
+    }
+    res.Body.Close()
+    if res.StatusCode != http.StatusNoContent {
+        r.Stats.PushErrors.Add(1)
+        log.Printf("WARNING: error handing off %s/%s to %s: %v", groupName, key, owner, res.Status)
+        return false
+    }
+    r.Stats.KeysPushed.Add(1)
+    r.Stats.BytesPushed.Add(int64(len(value)))
+    return true
+}
@@ -0,0 +1,57 @@
+package ring_test
+
+import (
+    "context"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "sync"
+    "testing"
+    "time"
+    "github.com/robwil/peer-aware-groupcache/groupcache"
+    "github.com/robwil/peer-aware-groupcache/ring"
+)
+
+// stuckPeer accepts handoffs, and then holds on to them until their sender gives up.
+func stuckPeer(t *testing.T) (*httptest.Server, <-chan struct{}) {
+    received := make(chan struct{})
+    var once sync.Once
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        ioutil.ReadAll(r.Body) // for the server to notice when the sender gives up
+        once.Do(func() { close(received) })
+        <-r.Context().Done()
+    }))
+    t.Cleanup(server.Close)
+    return server, received
+}
+
+func TestDrainInterruptsRebalance(t *testing.T) {
+    const self = "http://self"
+    pool := ring.NewPool(self, nil)
+    pool.Set(self)
+    group := groupcache.NewGroup("rebalance-drain", 1<<20, groupcache.GetterFunc(func(_ groupcache.Context, key string, dest groupcache.Sink) error {
+        return dest.SetString(key)
+    }))
+    for i := 0; i < 100; i++ {
+        group.Populate(strconv.Itoa(i), []byte("value"), time.Time{})
+    }
+    rebalancer := ring.NewRebalancer(pool, []*groupcache.Group{group}, &ring.RebalanceOptions{Delay: time.Millisecond})
+
+    peer, received := stuckPeer(t)
+    pool.Set(self, peer.URL)
+    select {
+    case <-received:
+    case <-time.After(5 * time.Second):
+        t.Fatal("no key handed off after the ring changed")
+    }
+
+    // the rebalance is now stuck pushing a key, which Drain must not wait for past its own deadline
+    ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+    defer cancel()
+    start := time.Now()
+    rebalancer.Drain(ctx)
+    if elapsed := time.Since(start); elapsed > 2*time.Second {
+        t.Errorf("Drain took %v, past its deadline", elapsed)
+    }
+}
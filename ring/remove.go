@@ -0,0 +1,105 @@
+package ring
+
+import (
+    "context"
+    "fmt"
+    "net/http"
+    "net/url"
+    "strings"
+    "sync"
+    "github.com/robwil/peer-aware-groupcache/groupcache"
+)
+
+// Remove removes key from the named group on every peer of the pool, e.g. to evict a bad value rather than wait for
+// it to expire or be evicted. The key is removed from its owner first, so that peers fetching it again from then on
+// get a fresh value, and then from every other peer at once, as any of them may hold a copy in its hot cache (or in
+// its main cache, as the key's previous owner). The current peer removes it from its own caches directly, and other
+// peers must let the current one write (see Handler.AllowWrite).
+//
+// The peers may change while the key is being removed: peers which join in the meantime (e.g. a new owner) are sent
+// the removal too, until every current peer has been, and peers which fail because they left in the meantime do not
+// matter. The returned error lists the peers still in the pool which failed to remove the key, and keep their copy
+// until it expires or is evicted.
+func (p *Pool) Remove(ctx context.Context, groupName string, key string) error {
+    if groupcache.GetGroup(groupName) == nil {
+        return fmt.Errorf("no such group: %s", groupName)
+    }
+    failed := make(map[string]error)
+    sent := make(map[string]bool)
+    if owner := p.Owner(key); owner != "" {
+        sent[owner] = true
+        if err := p.removeFrom(ctx, owner, groupName, key); err != nil {
+            failed[owner] = err
+        }
+    }
+    for {
+        var pending []string
+        for _, peer := range append(p.Peers(), p.self) {
+            if !sent[peer] {
+                sent[peer] = true
+                pending = append(pending, peer)
+            }
+        }
+        if len(pending) == 0 {
+            break
+        }
+        errs := make([]error, len(pending))
+        var wg sync.WaitGroup
+        for i, peer := range pending {
+            wg.Add(1)
+            go func(i int, peer string) {
+                defer wg.Done()
+                errs[i] = p.removeFrom(ctx, peer, groupName, key)
+            }(i, peer)
+        }
+        wg.Wait()
+        for i, err := range errs {
+            if err != nil {
+                failed[pending[i]] = err
+            }
+        }
+    }
+
+    var errs []string
+    for _, peer := range p.Peers() {
+        if err, ok := failed[peer]; ok {
+            errs = append(errs, fmt.Sprintf("%s: %v", peer, err))
+        }
+    }
+    if len(errs) > 0 {
+        return fmt.Errorf("error removing %s/%s from %d peers: %s", groupName, key, len(errs), strings.Join(errs, "; "))
+    }
+    return nil
+}
+
+// removeFrom removes key from the named group on peer, which may be the current peer.
+func (p *Pool) removeFrom(ctx context.Context, peer string, groupName string, key string) error {
+    if peer == p.self {
+        groupcache.GetGroup(groupName).Remove(key)
+        return nil
+    }
+    if p.opts.PeerTimeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, p.opts.PeerTimeout)
+        defer cancel()
+    }
+    u := fmt.Sprintf("%v%v%v/%v", peer, p.opts.BasePath, url.QueryEscape(groupName), url.QueryEscape(key))
+    req, err := http.NewRequest("DELETE", u, nil)
+    if err != nil {
+        return err
+    }
+    req = req.WithContext(ctx)
+    tr := http.DefaultTransport
+    if p.opts.Transport != nil {
+        tr = p.opts.Transport(ctx)
+    }
+    res, err := tr.RoundTrip(req)
+    if err != nil {
+        return err
+    }
+    res.Body.Close()
+    if res.StatusCode != http.StatusNoContent {
+        return fmt.Errorf("server returned: %v", res.Status)
+    }
+    return nil
+}
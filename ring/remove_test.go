@@ -0,0 +1,67 @@
+package ring_test
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+    "github.com/robwil/peer-aware-groupcache/groupcache"
+    "github.com/robwil/peer-aware-groupcache/ring"
+)
+
+// removals records the peers which were asked to remove a key, in order.
+type removals struct {
+    mu    sync.Mutex
+    peers []string
+}
+
+// peer serves removals, answering with status.
+func (r *removals) peer(t *testing.T, status int) *httptest.Server {
+    var server *httptest.Server
+    server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        if req.Method != "DELETE" || req.URL.Path != "/_groupcache/remove/bad-key" {
+            t.Errorf("peer got %s %s, want DELETE /_groupcache/remove/bad-key", req.Method, req.URL.Path)
+        }
+        r.mu.Lock()
+        r.peers = append(r.peers, server.URL)
+        r.mu.Unlock()
+        w.WriteHeader(status)
+    }))
+    t.Cleanup(server.Close)
+    return server
+}
+
+func TestRemove(t *testing.T) {
+    const self = "http://self"
+    group := groupcache.NewGroup("remove", 1<<20, groupcache.GetterFunc(func(_ groupcache.Context, key string, dest groupcache.Sink) error {
+        return dest.SetString(key)
+    }))
+    group.Populate("bad-key", []byte("bad value"), time.Time{})
+
+    var got removals
+    peers := []string{got.peer(t, http.StatusNoContent).URL, got.peer(t, http.StatusNoContent).URL, got.peer(t, http.StatusNoContent).URL}
+    failing := got.peer(t, http.StatusInternalServerError).URL
+    pool := ring.NewPool(self, nil)
+    pool.Set(append(peers, self, failing)...)
+
+    err := pool.Remove(context.Background(), "remove", "bad-key")
+    if err == nil || !strings.Contains(err.Error(), failing) || strings.Count(err.Error(), "http://") != 1 {
+        t.Errorf("Remove error = %v, want one listing only %s", err, failing)
+    }
+    if _, ok := group.Peek("bad-key"); ok {
+        t.Errorf("key still cached by the current peer")
+    }
+    if len(got.peers) != 4 {
+        t.Fatalf("removal sent to %v, want every other peer once", got.peers)
+    }
+    if owner := pool.Owner("bad-key"); owner != self && got.peers[0] != owner {
+        t.Errorf("removal sent to %s first, want its owner %s", got.peers[0], owner)
+    }
+
+    if err := pool.Remove(context.Background(), "missing", "bad-key"); err == nil {
+        t.Errorf("Remove from a missing group succeeded")
+    }
+}
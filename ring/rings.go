@@ -0,0 +1,104 @@
+package ring
+
+import (
+    "sync"
+    "github.com/robwil/peer-aware-groupcache/groupcache"
+    "github.com/robwil/peer-aware-groupcache/peerbind"
+)
+
+// Rings binds groupcache groups to named Pools.
+type Rings struct {
+    mu       sync.Mutex
+    pools    map[string]*Pool                 // keyed by ring name
+    pickers  map[string]groupcache.PeerPicker // keyed by ring name, overriding the ring's Pool
+    groups   map[string]string                // group name -> ring name
+    bindings []*peerbind.Binding
+}
+
+// NewRings creates an empty set of rings and registers it as groupcache's per-group peer picker.
+// As with groupcache.NewHTTPPool, it must be called at most once, and not alongside NewHTTPPool.
+func NewRings() *Rings {
+    r := &Rings{
+        pools:   make(map[string]*Pool),
+        pickers: make(map[string]groupcache.PeerPicker),
+        groups:  make(map[string]string),
+    }
+    groupcache.RegisterPerGroupPeerPicker(r.picker)
+    return r
+}
+
+// Add adds a named ring.
+func (r *Rings) Add(name string, pool *Pool) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.pools[name] = pool
+}
+
+// Pool returns the named ring, or nil if there is none.
+func (r *Rings) Pool(name string) *Pool {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return r.pools[name]
+}
+
+// SetPicker makes the groups bound to the named ring pick their peers through picker, e.g. a Breaker wrapping
+// the ring's Pool, rather than through the Pool itself. As with Bind, this has to happen before the groups are used.
+func (r *Rings) SetPicker(ringName string, picker groupcache.PeerPicker) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.pickers[ringName] = picker
+}
+
+// Picker returns what the groups bound to the named ring pick their peers through: the picker set with SetPicker,
+// or else the ring's Pool. It returns nil if there is no such ring.
+func (r *Rings) Picker(ringName string) groupcache.PeerPicker {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if picker, ok := r.pickers[ringName]; ok {
+        return picker
+    }
+    if pool, ok := r.pools[ringName]; ok {
+        return pool
+    }
+    return nil
+}
+
+// Bind makes the group pick its peers from the named ring. Groups pick their peers the first time they are used,
+// so this has to happen before then; groups which are never bound have no peers.
+func (r *Rings) Bind(groupName string, ringName string) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.groups[groupName] = ringName
+}
+
+func (r *Rings) picker(groupName string) groupcache.PeerPicker {
+    r.mu.Lock()
+    ringName := r.groups[groupName]
+    r.mu.Unlock()
+    return r.Picker(ringName)
+}
+
+// PoolOf returns the pool of the ring the named group is bound to, or nil if there is none.
+func (r *Rings) PoolOf(groupName string) *Pool {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return r.pools[r.groups[groupName]]
+}
+
+// Bindings returns the bindings of the rings created by NewGroup.
+func (r *Rings) Bindings() []*peerbind.Binding {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return append([]*peerbind.Binding(nil), r.bindings...)
+}
+
+// Pools returns every ring, keyed by name.
+func (r *Rings) Pools() map[string]*Pool {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    pools := make(map[string]*Pool, len(r.pools))
+    for name, pool := range r.pools {
+        pools[name] = pool
+    }
+    return pools
+}
@@ -0,0 +1,410 @@
+package ring
+
+import (
+    "hash/crc32"
+    "hash/fnv"
+    "math"
+    "sort"
+    "strconv"
+    "sync"
+    "github.com/golang/groupcache/consistenthash"
+)
+
+// Hash maps keys to the peers of a ring.
+type Hash interface {
+    // Get returns the peer owning key, or "" if there are no peers.
+    Get(key string) string
+    // GetN returns the owner of key followed by up to n-1 other peers, in the order they would own key if the
+    // peers before them were gone.
+    GetN(key string, n int) []string
+    IsEmpty() bool
+}
+
+// Strategy decides how keys are spread over the peers of a Pool. Every peer must use the same Strategy (with the
+// same settings) for a ring, so that they agree on the owner of each key.
+type Strategy interface {
+    // Hash returns the Hash of the given peers.
+    Hash(peers []string) Hash
+}
+
+// WeightedStrategy is implemented by Strategies which can give some peers a larger share of keys than others.
+type WeightedStrategy interface {
+    Strategy
+    // WeightedHash returns the Hash of the given peers, whose shares of keys are proportional to their weights,
+    // keyed by peer. Peers missing from weights weigh 1.
+    WeightedHash(peers []string, weights map[string]float64) Hash
+}
+
+// weight returns the weight of peer in weights.
+func weight(weights map[string]float64, peer string) float64 {
+    if w, ok := weights[peer]; ok && w > 0 {
+        return w
+    }
+    return 1
+}
+
+// virtualNodes returns the number of virtual nodes of a peer with the given weight, replicas being that of weight 1.
+func virtualNodes(replicas int, weight float64) int {
+    n := int(math.Round(float64(replicas) * weight))
+    if n < 1 {
+        return 1
+    }
+    return n
+}
+
+// hashRing is a hash ring like consistenthash.Map, but on which every peer has a number of virtual nodes
+// proportional to its weight. With equal weights, it is the same ring as consistenthash.Map's.
+type hashRing struct {
+    hashFn consistenthash.Hash
+    points []uint32
+    owners map[uint32]string
+}
+
+func newHashRing(peers []string, weights map[string]float64, replicas int, hashFn consistenthash.Hash) *hashRing {
+    if replicas == 0 {
+        replicas = defaultReplicas
+    }
+    if hashFn == nil {
+        hashFn = crc32.ChecksumIEEE
+    }
+    r := &hashRing{hashFn: hashFn, owners: make(map[uint32]string)}
+    for _, peer := range peers {
+        for i := 0; i < virtualNodes(replicas, weight(weights, peer)); i++ {
+            point := hashFn([]byte(strconv.Itoa(i) + peer))
+            r.points = append(r.points, point)
+            r.owners[point] = peer
+        }
+    }
+    sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+    return r
+}
+
+// search returns the index of the point owning key, the first one at or after its hash.
+func (r *hashRing) search(key string) int {
+    point := r.hashFn([]byte(key))
+    i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= point })
+    if i == len(r.points) {
+        return 0
+    }
+    return i
+}
+
+func (r *hashRing) Get(key string) string {
+    if len(r.points) == 0 {
+        return ""
+    }
+    return r.owners[r.points[r.search(key)]]
+}
+
+func (r *hashRing) GetN(key string, n int) []string {
+    if len(r.points) == 0 {
+        return nil
+    }
+    var peers []string
+    seen := make(map[string]bool, n)
+    start := r.search(key)
+    for i := 0; i < len(r.points) && len(peers) < n; i++ {
+        if peer := r.owners[r.points[(start+i)%len(r.points)]]; !seen[peer] {
+            seen[peer] = true
+            peers = append(peers, peer)
+        }
+    }
+    return peers
+}
+
+func (r *hashRing) IsEmpty() bool {
+    return len(r.points) == 0
+}
+
+// Consistent is the consistent hashing of groupcache.HTTPPool, placing Replicas virtual nodes of every peer on a
+// hash ring. It is the default Strategy. When a peer joins or leaves, only the keys it owns move. Weighted peers get
+// Replicas virtual nodes per unit of weight.
+type Consistent struct {
+    // Replicas is the number of virtual nodes per peer. Defaults to 50.
+    Replicas int
+    // HashFn is the hash function of the ring. Defaults to crc32.ChecksumIEEE.
+    HashFn consistenthash.Hash
+}
+
+func (s Consistent) Hash(peers []string) Hash {
+    return s.WeightedHash(peers, nil)
+}
+
+func (s Consistent) WeightedHash(peers []string, weights map[string]float64) Hash {
+    return newHashRing(peers, weights, s.Replicas, s.HashFn)
+}
+
+// Rendezvous is rendezvous (highest random weight) hashing: every key goes to the peer scoring highest for it. Keys
+// are spread evenly without virtual nodes, and when a peer joins or leaves only the keys it owns move, at the cost
+// of scoring every peer on each lookup. Weighted peers have their scores scaled as in weighted rendezvous hashing
+// (Schindelhauer and Schomaker), so that they win keys in proportion to their weights.
+type Rendezvous struct{}
+
+func (s Rendezvous) Hash(peers []string) Hash {
+    return s.WeightedHash(peers, nil)
+}
+
+func (Rendezvous) WeightedHash(peers []string, weights map[string]float64) Hash {
+    h := rendezvousHash{peers: append([]string(nil), peers...), seeds: make([]uint64, len(peers))}
+    for i, peer := range peers {
+        h.seeds[i] = hash64(peer)
+    }
+    if len(weights) > 0 {
+        h.weights = make([]float64, len(peers))
+        for i, peer := range peers {
+            h.weights[i] = weight(weights, peer)
+        }
+    }
+    return h
+}
+
+type rendezvousHash struct {
+    peers   []string
+    seeds   []uint64
+    weights []float64 // of each peer, nil if all weigh 1
+}
+
+func (h rendezvousHash) Get(key string) string {
+    if h.weights != nil {
+        return h.getWeighted(key)
+    }
+    k := hash64(key)
+    best, bestScore := "", uint64(0)
+    for i, peer := range h.peers {
+        // ties go to the smaller peer, so that the order of peers does not matter
+        if score := mix64(h.seeds[i] ^ k); best == "" || score > bestScore || (score == bestScore && peer < best) {
+            best, bestScore = peer, score
+        }
+    }
+    return best
+}
+
+func (h rendezvousHash) getWeighted(key string) string {
+    k := hash64(key)
+    best, bestScore := "", 0.0
+    for i, peer := range h.peers {
+        // a uniform number in (0, 1), from the top 53 bits of the unweighted score
+        u := (float64(mix64(h.seeds[i]^k)>>11) + 0.5) / (1 << 53)
+        if score := -h.weights[i] / math.Log(u); best == "" || score > bestScore || (score == bestScore && peer < best) {
+            best, bestScore = peer, score
+        }
+    }
+    return best
+}
+
+func (h rendezvousHash) GetN(key string, n int) []string {
+    if len(h.peers) == 0 || n <= 0 {
+        return nil
+    }
+    type scored struct {
+        peer  string
+        score float64
+    }
+    k := hash64(key)
+    scores := make([]scored, len(h.peers))
+    for i, peer := range h.peers {
+        u := (float64(mix64(h.seeds[i]^k)>>11) + 0.5) / (1 << 53)
+        w := 1.0
+        if h.weights != nil {
+            w = h.weights[i]
+        }
+        scores[i] = scored{peer, -w / math.Log(u)}
+    }
+    sort.Slice(scores, func(i, j int) bool {
+        if scores[i].score != scores[j].score {
+            return scores[i].score > scores[j].score
+        }
+        return scores[i].peer < scores[j].peer
+    })
+    // the owner is exactly that of Get, as unweighted scores are more precise than these
+    peers := []string{h.Get(key)}
+    for _, s := range scores {
+        if len(peers) >= n {
+            break
+        }
+        if s.peer != peers[0] {
+            peers = append(peers, s.peer)
+        }
+    }
+    return peers
+}
+
+func (h rendezvousHash) IsEmpty() bool {
+    return len(h.peers) == 0
+}
+
+// Jump is jump consistent hashing (Lamping and Veach), which spreads keys evenly over the peers sorted by URL with
+// neither virtual nodes nor scoring every peer. Only peers joining or leaving at the end of the sorted order move
+// the minimum number of keys: any other change shifts the peers after it, and with them many more keys, so it suits
+// rings whose membership rarely changes. Jump ignores the weights of peers.
+type Jump struct{}
+
+func (Jump) Hash(peers []string) Hash {
+    sorted := append([]string(nil), peers...)
+    sort.Strings(sorted)
+    return jumpHash(sorted)
+}
+
+type jumpHash []string
+
+func (h jumpHash) Get(key string) string {
+    if len(h) == 0 {
+        return ""
+    }
+    return h[jump(hash64(key), len(h))]
+}
+
+func (h jumpHash) GetN(key string, n int) []string {
+    if len(h) == 0 {
+        return nil
+    }
+    var peers []string
+    b := jump(hash64(key), len(h))
+    for i := 0; i < len(h) && i < n; i++ {
+        peers = append(peers, h[(b+i)%len(h)])
+    }
+    return peers
+}
+
+func (h jumpHash) IsEmpty() bool {
+    return len(h) == 0
+}
+
+// jump returns the bucket of key among the given number of buckets.
+func jump(key uint64, buckets int) int {
+    b, j := int64(-1), int64(0)
+    for j < int64(buckets) {
+        b = j
+        key = key*2862933555777941757 + 1
+        j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+    }
+    return int(b)
+}
+
+// BoundedLoads is consistent hashing with bounded loads (Mirrokni, Thorup and Zadimoghaddam): keys go to their
+// owner on the hash ring unless that peer already has more than Factor times the average load, in which case they
+// go to the next peer along the ring which does not. Load is the number of requests the current peer has in flight
+// to each peer, so a BoundedLoads must not be shared between Pools.
+//
+// As the current peer only knows its own requests, peers may disagree on the owner of a key while one of them is
+// overloaded: a peer passed a key because its owner is overloaded sends it straight back to the owner, and a
+// Rebalancer hands keys off depending on the load at the time. BoundedLoads is therefore only meant for clients of
+// the peers, which pick the peer to send each request to without serving any themselves, and not for the Pools
+// the peers use among each other.
+//
+// Weighted peers get Replicas virtual nodes per unit of weight, and a share of the total load proportional to their
+// weight.
+type BoundedLoads struct {
+    // Replicas is the number of virtual nodes per peer. Defaults to 50.
+    Replicas int
+    // HashFn is the hash function of the ring. Defaults to crc32.ChecksumIEEE.
+    HashFn consistenthash.Hash
+    // Factor is how many times the average load a peer may have. Defaults to 1.25.
+    Factor float64
+
+    mu    sync.Mutex       // guards loads and total
+    loads map[string]int64 // requests in flight, keyed by peer
+    total int64
+}
+
+const defaultBoundedLoadFactor = 1.25
+
+// Acquire counts a request starting to peer.
+func (s *BoundedLoads) Acquire(peer string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.loads == nil {
+        s.loads = make(map[string]int64)
+    }
+    s.loads[peer]++
+    s.total++
+}
+
+// Release counts a request to peer which is done.
+func (s *BoundedLoads) Release(peer string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.loads[peer] > 0 {
+        s.loads[peer]--
+        s.total--
+    }
+}
+
+func (s *BoundedLoads) Hash(peers []string) Hash {
+    return s.WeightedHash(peers, nil)
+}
+
+func (s *BoundedLoads) WeightedHash(peers []string, weights map[string]float64) Hash {
+    h := &boundedHash{strategy: s, ring: newHashRing(peers, weights, s.Replicas, s.HashFn), weights: weights}
+    for _, peer := range peers {
+        h.totalWeight += weight(weights, peer)
+    }
+    return h
+}
+
+type boundedHash struct {
+    strategy    *BoundedLoads
+    ring        *hashRing
+    weights     map[string]float64
+    totalWeight float64
+}
+
+func (h *boundedHash) Get(key string) string {
+    points := h.ring.points
+    if len(points) == 0 {
+        return ""
+    }
+    start := h.ring.search(key)
+
+    s := h.strategy
+    factor := s.Factor
+    if factor <= 0 {
+        factor = defaultBoundedLoadFactor
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for i := 0; i < len(points); i++ {
+        peer := h.ring.owners[points[(start+i)%len(points)]]
+        limit := int64(math.Ceil(factor * float64(s.total+1) * weight(h.weights, peer) / h.totalWeight))
+        if s.loads[peer]+1 <= limit {
+            return peer
+        }
+    }
+    return h.ring.owners[points[start]]
+}
+
+// GetN returns the owner of key as Get does, followed by the next peers along the ring regardless of their loads.
+func (h *boundedHash) GetN(key string, n int) []string {
+    owner := h.Get(key)
+    if owner == "" || n <= 0 {
+        return nil
+    }
+    peers := []string{owner}
+    for _, peer := range h.ring.GetN(key, n+1) {
+        if len(peers) < n && peer != owner {
+            peers = append(peers, peer)
+        }
+    }
+    return peers
+}
+
+func (h *boundedHash) IsEmpty() bool {
+    return h.ring.IsEmpty()
+}
+
+// hash64 hashes s for the strategies which need 64 bits.
+func hash64(s string) uint64 {
+    h := fnv.New64a()
+    h.Write([]byte(s))
+    return mix64(h.Sum64())
+}
+
+// mix64 is the finalizer of SplitMix64, spreading the bits of x over the whole result.
+func mix64(x uint64) uint64 {
+    x ^= x >> 30
+    x *= 0xbf58476d1ce4e5b9
+    x ^= x >> 27
+    x *= 0x94d049bb133111eb
+    x ^= x >> 31
+    return x
+}
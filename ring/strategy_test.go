@@ -0,0 +1,109 @@
+package ring_test
+
+import (
+    "fmt"
+    "testing"
+    "github.com/robwil/peer-aware-groupcache/ring"
+)
+
+const testKeys = 100000
+
+func testPeers(n int) []string {
+    var peers []string
+    for i := 1; i <= n; i++ {
+        peers = append(peers, fmt.Sprintf("http://10.0.0.%d:5000", i))
+    }
+    return peers
+}
+
+// owners returns the owner of every test key.
+func owners(h ring.Hash) []string {
+    owners := make([]string, testKeys)
+    for i := range owners {
+        owners[i] = h.Get(fmt.Sprint("key-", i))
+    }
+    return owners
+}
+
+var strategies = []struct {
+    name     string
+    strategy ring.Strategy
+    maxShare float64 // largest share of keys of a peer, as a multiple of the average
+}{
+    {"consistent", ring.Consistent{Replicas: 50}, 1.5},
+    {"rendezvous", ring.Rendezvous{}, 1.05},
+    {"jump", ring.Jump{}, 1.05},
+}
+
+func TestStrategyDistribution(t *testing.T) {
+    peers := testPeers(10)
+    for _, tt := range strategies {
+        t.Run(tt.name, func(t *testing.T) {
+            counts := make(map[string]int)
+            for _, owner := range owners(tt.strategy.Hash(peers)) {
+                counts[owner]++
+            }
+            if len(counts) != len(peers) {
+                t.Fatalf("keys went to %d peers, want all %d", len(counts), len(peers))
+            }
+            average := float64(testKeys) / float64(len(peers))
+            for peer, count := range counts {
+                if share := float64(count) / average; share > tt.maxShare {
+                    t.Errorf("%s owns %.2f times the average number of keys, want at most %.2f", peer, share, tt.maxShare)
+                }
+            }
+        })
+    }
+}
+
+func TestStrategyMovement(t *testing.T) {
+    peers := testPeers(10)
+    // sorts after the other peers, for Jump to move as few keys as the others
+    joining := "http://10.0.1.1:5000"
+    for _, tt := range strategies {
+        t.Run(tt.name, func(t *testing.T) {
+            before := owners(tt.strategy.Hash(peers))
+            after := owners(tt.strategy.Hash(append(append([]string(nil), peers...), joining)))
+            moved := 0
+            for i := range before {
+                if before[i] == after[i] {
+                    continue
+                }
+                moved++
+                if after[i] != joining {
+                    t.Fatalf("key-%d moved from %s to %s, want only keys moving to the joining peer", i, before[i], after[i])
+                }
+            }
+            // the joining peer should take about its fair share, 1/11 of the keys
+            if fair := testKeys / (len(peers) + 1); moved < fair/2 || moved > fair*3/2 {
+                t.Errorf("%d keys moved, want about %d", moved, fair)
+            }
+        })
+    }
+}
+
+func TestBoundedLoads(t *testing.T) {
+    peers := testPeers(10)
+    bounded := &ring.BoundedLoads{Replicas: 50}
+    h, consistent := bounded.Hash(peers), ring.Consistent{Replicas: 50}.Hash(peers)
+
+    key := "key-0"
+    owner := consistent.Get(key)
+    if got := h.Get(key); got != owner {
+        t.Fatalf("owner without load = %s, want %s as with consistent hashing", got, owner)
+    }
+
+    for i := 0; i < 10; i++ {
+        bounded.Acquire(owner)
+    }
+    if got, want := h.Get(key), consistent.GetN(key, 2)[1]; got != want {
+        t.Errorf("owner while %s is overloaded = %s, want the next peer along the ring %s", owner, got, want)
+    }
+
+    for i := 0; i < 10; i++ {
+        bounded.Release(owner)
+    }
+    if got := h.Get(key); got != owner {
+        t.Errorf("owner once the load is gone = %s, want %s again", got, owner)
+    }
+}
@@ -0,0 +1,202 @@
+package ring
+
+import (
+    "sort"
+    "sync"
+    "time"
+    "github.com/robwil/peer-aware-groupcache/groupcache"
+)
+
+const (
+    defaultZoneHotThreshold = 3
+    defaultZoneHotWindow    = time.Minute
+)
+
+// ZoneOptions configures Zones.
+type ZoneOptions struct {
+    // Replicate has hot keys owned in another zone fetched from a zone-local owner, which keeps them in its hot
+    // cache, rather than each from the global owner. Defaults to false, which only counts fetches by zone.
+    Replicate bool
+    // HotThreshold is how many times a key owned in another zone must be loaded within HotWindow to be hot.
+    // Defaults to 3.
+    HotThreshold int
+    // HotWindow is the period over which loads of keys are counted. Defaults to a minute.
+    HotWindow time.Duration
+}
+
+// ZoneStats are statistics on the fetches from peers by the zone of the key's owner, as picked by Zones.
+type ZoneStats struct {
+    InZone      groupcache.AtomicInt // fetches from peers in the current peer's zone, including zone-local owners
+    CrossZone   groupcache.AtomicInt // fetches from peers in another zone
+    UnknownZone groupcache.AtomicInt // fetches from peers whose zone (or the current peer's) is not known
+    ZoneLocal   groupcache.AtomicInt // fetches of hot keys from their zone-local owner, instead of another zone
+}
+
+// Zones is a groupcache.PeerPicker which knows the zone of every peer of a Pool, so as to count how many fetches
+// cross zones, and optionally replicate hot keys within each zone to avoid crossing them.
+//
+// Every key still has a single global owner, which alone loads it. With Replicate, every zone also has a zone-local
+// owner for each key: the owner of the key among the peers of that zone alone. Keys owned in another zone which get
+// hot are fetched from their zone-local owner instead, which fetches them from the global owner once and keeps them
+// in its hot cache (see groupcache.HotCachePicker), so that reads of hot keys stay within the zone.
+//
+// Use Rings.SetPicker to have the groups of a ring pick their peers through Zones.
+type Zones struct {
+    pool *Pool
+    next groupcache.PeerPicker
+    opts ZoneOptions
+    hot  *keyCounts
+
+    mu    sync.Mutex        // guards zones and local
+    zones map[string]string // keyed by peer base URL
+    local Hash              // ring of the peers in the current peer's zone, nil until needed
+
+    Stats ZoneStats
+}
+
+// NewZones creates a Zones picking peers from pool, through next (e.g. a Breaker wrapping pool) if not nil. Keys
+// are only fetched from their zone-local owner directly from pool. opts may be nil to use the defaults.
+func NewZones(pool *Pool, next groupcache.PeerPicker, opts *ZoneOptions) *Zones {
+    z := &Zones{pool: pool, next: next, zones: make(map[string]string)}
+    if z.next == nil {
+        z.next = pool
+    }
+    if opts != nil {
+        z.opts = *opts
+    }
+    if z.opts.HotThreshold <= 0 {
+        z.opts.HotThreshold = defaultZoneHotThreshold
+    }
+    if z.opts.HotWindow <= 0 {
+        z.opts.HotWindow = defaultZoneHotWindow
+    }
+    z.hot = newKeyCounts(z.opts.HotWindow, 0)
+    pool.Subscribe(z.peersChanged)
+    return z
+}
+
+func (z *Zones) peersChanged(_ []string, _ []string) {
+    z.mu.Lock()
+    defer z.mu.Unlock()
+    z.local = nil
+}
+
+// SetZones sets the zones of peers, keyed by base URL, e.g. as discovered by peerwatch.WatchZones. Peers missing
+// from zones are in an unknown zone.
+func (z *Zones) SetZones(zones map[string]string) {
+    z.mu.Lock()
+    defer z.mu.Unlock()
+    z.zones = make(map[string]string, len(zones))
+    for peer, zone := range zones {
+        z.zones[peer] = zone
+    }
+    z.local = nil
+}
+
+// Zone returns the zone of the current peer, or "" if it is not known.
+func (z *Zones) Zone() string {
+    z.mu.Lock()
+    defer z.mu.Unlock()
+    return z.zones[z.pool.Self()]
+}
+
+// PeersByZone returns the pool's current peers in each zone, sorted. Peers in an unknown zone are under "".
+func (z *Zones) PeersByZone() map[string][]string {
+    z.mu.Lock()
+    defer z.mu.Unlock()
+    byZone := make(map[string][]string)
+    for _, peer := range z.pool.Peers() {
+        byZone[z.zones[peer]] = append(byZone[z.zones[peer]], peer)
+    }
+    for _, peers := range byZone {
+        sort.Strings(peers)
+    }
+    return byZone
+}
+
+// crossZone returns whether owner is known to be in another zone than the current peer, and whether the zones of
+// both are known at all.
+func (z *Zones) crossZone(owner string) (cross bool, known bool) {
+    z.mu.Lock()
+    defer z.mu.Unlock()
+    self, other := z.zones[z.pool.Self()], z.zones[owner]
+    if self == "" || other == "" {
+        return false, false
+    }
+    return self != other, true
+}
+
+// localOwner returns the zone-local owner of key.
+func (z *Zones) localOwner(key string) string {
+    z.mu.Lock()
+    defer z.mu.Unlock()
+    if z.local == nil {
+        zone := z.zones[z.pool.Self()]
+        var peers []string
+        for _, peer := range z.pool.Peers() {
+            if z.zones[peer] == zone {
+                peers = append(peers, peer)
+            }
+        }
+        z.local = z.pool.newHash(peers)
+    }
+    return z.local.Get(key)
+}
+
+func (z *Zones) PickPeer(key string) (groupcache.ProtoGetter, bool) {
+    owner := z.pool.Owner(key)
+    if owner == "" || owner == z.pool.Self() {
+        return nil, false
+    }
+    cross, known := z.crossZone(owner)
+    switch {
+    case !known:
+        z.Stats.UnknownZone.Add(1)
+    case !cross:
+        z.Stats.InZone.Add(1)
+    case z.opts.Replicate && !z.nextKeepsHot(key) && z.hot.add(key) >= z.opts.HotThreshold:
+        if local := z.localOwner(key); local != "" && local != z.pool.Self() {
+            if getter, ok := z.pool.getter(local); ok {
+                z.Stats.InZone.Add(1)
+                z.Stats.ZoneLocal.Add(1)
+                return getter, true
+            }
+        }
+        // the current peer is the zone-local owner, which fetches from the global owner and keeps the key hot
+        z.Stats.CrossZone.Add(1)
+    default:
+        z.Stats.CrossZone.Add(1)
+    }
+    return z.next.PickPeer(key)
+}
+
+// PickPreviousPeer implements groupcache.PreviousPeerPicker, see Pool.PickPreviousPeer.
+func (z *Zones) PickPreviousPeer(key string) (groupcache.ProtoGetter, bool) {
+    if previous, ok := z.next.(groupcache.PreviousPeerPicker); ok {
+        return previous.PickPreviousPeer(key)
+    }
+    return z.pool.PickPreviousPeer(key)
+}
+
+// nextKeepsHot returns whether next keeps key hot itself, e.g. as a replica of HotKeys, in which case key is
+// fetched the way next picks, so that requests cannot go around in circles between zone-local owners and replicas.
+func (z *Zones) nextKeepsHot(key string) bool {
+    hot, ok := z.next.(groupcache.HotCachePicker)
+    return ok && hot.KeepHot(key)
+}
+
+// KeepHot implements groupcache.HotCachePicker: the zone-local owner of a hot key owned in another zone keeps it, as
+// does anyone next keeps hot keys for.
+func (z *Zones) KeepHot(key string) bool {
+    if z.nextKeepsHot(key) {
+        return true
+    }
+    if !z.opts.Replicate {
+        return false
+    }
+    owner := z.pool.Owner(key)
+    if cross, _ := z.crossZone(owner); !cross {
+        return false
+    }
+    return z.hot.count(key) >= z.opts.HotThreshold && z.localOwner(key) == z.pool.Self()
+}
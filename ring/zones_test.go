@@ -0,0 +1,94 @@
+package ring_test
+
+import (
+    "fmt"
+    "testing"
+    "github.com/robwil/peer-aware-groupcache/ring"
+)
+
+const (
+    inZone    = "http://10.0.1.1:5000"
+    otherZone = "http://10.0.2.1:5000"
+    unknown   = "http://10.0.3.1:5000"
+)
+
+// zonedPool returns a pool whose current peer is in zone a along with inZone, while otherZone is in zone b and the
+// zone of unknown is not known.
+func zonedPool(next *countingPicker, opts *ring.ZoneOptions) (*ring.Pool, *ring.Zones) {
+    const self = "http://self"
+    pool := ring.NewPool(self, nil)
+    pool.Set(self, inZone, otherZone, unknown)
+    zones := ring.NewZones(pool, next, opts)
+    zones.SetZones(map[string]string{self: "a", inZone: "a", otherZone: "b"})
+    return pool, zones
+}
+
+func TestZonesCountFetches(t *testing.T) {
+    next := &countingPicker{}
+    pool, zones := zonedPool(next, nil)
+    for _, owner := range []string{inZone, otherZone, otherZone, unknown} {
+        key := keyWhere(t, pool, 1, func(owners []string) bool { return owners[0] == owner })
+        if _, ok := zones.PickPeer(key); !ok {
+            t.Fatalf("no peer picked for a key owned by %s", owner)
+        }
+    }
+    if in, cross, unknown := zones.Stats.InZone.Get(), zones.Stats.CrossZone.Get(), zones.Stats.UnknownZone.Get(); in != 1 || cross != 2 || unknown != 1 {
+        t.Errorf("fetches in-zone, cross-zone and in unknown zones = %d, %d, %d, want 1, 2, 1", in, cross, unknown)
+    }
+    if next.picks != 4 {
+        t.Errorf("%d of 4 fetches went to the owner, want all without Replicate", next.picks)
+    }
+    if got := zones.PeersByZone()["b"]; len(got) != 1 || got[0] != otherZone {
+        t.Errorf("peers of zone b = %v, want [%s]", got, otherZone)
+    }
+}
+
+func TestZonesReplicateHotKeys(t *testing.T) {
+    next := &countingPicker{}
+    opts := &ring.ZoneOptions{Replicate: true, HotThreshold: 3}
+    pool, zones := zonedPool(next, opts)
+    local := ring.Consistent{Replicas: 50}.Hash([]string{pool.Self(), inZone})
+
+    // keys owned in zone b, whose zone-local owner is another peer or the current one
+    var remote, mine string
+    for i := 0; i < 10000 && (remote == "" || mine == ""); i++ {
+        key := fmt.Sprint("key-", i)
+        if pool.Owner(key) != otherZone {
+            continue
+        }
+        if local.Get(key) == inZone {
+            remote = key
+        } else {
+            mine = key
+        }
+    }
+    if remote == "" || mine == "" {
+        t.Fatal("no keys owned in zone b with each zone-local owner")
+    }
+
+    for i := 1; i < opts.HotThreshold; i++ {
+        zones.PickPeer(remote)
+    }
+    if next.picks != opts.HotThreshold-1 || zones.Stats.ZoneLocal.Get() != 0 {
+        t.Fatalf("%d of %d fetches of a key which is not hot yet went to its owner, want all", next.picks, opts.HotThreshold-1)
+    }
+    zones.PickPeer(remote)
+    if next.picks != opts.HotThreshold-1 || zones.Stats.ZoneLocal.Get() != 1 {
+        t.Errorf("hot key fetched from its owner in another zone, want from its zone-local owner %s", inZone)
+    }
+    if zones.KeepHot(remote) {
+        t.Errorf("hot key kept by a peer which is not its zone-local owner")
+    }
+
+    // the zone-local owner fetches hot keys from their owner, and keeps them
+    next.picks = 0
+    for i := 0; i < opts.HotThreshold; i++ {
+        zones.PickPeer(mine)
+    }
+    if next.picks != opts.HotThreshold {
+        t.Errorf("%d of %d fetches by the zone-local owner went to the owner, want all", next.picks, opts.HotThreshold)
+    }
+    if !zones.KeepHot(mine) {
+        t.Errorf("hot key not kept by its zone-local owner")
+    }
+}
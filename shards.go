@@ -0,0 +1,88 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "github.com/robwil/peer-aware-groupcache/groupcache"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "github.com/robwil/peer-aware-groupcache/peerbind"
+    "github.com/robwil/peer-aware-groupcache/peerwatch"
+    "github.com/robwil/peer-aware-groupcache/ring"
+)
+
+// shardRings holds one ring, and one primeFactors group, per shard.
+type shardRings struct {
+    myShard  string
+    rings    *ring.Rings
+    groups   map[string]*groupcache.Group
+    bindings map[string]*peerbind.Binding
+}
+
+// shards is only set when running sharded.
+var shards *shardRings
+
+func setupShards(myIp string, myShard string, listOptions metav1.ListOptions, shardLabel string, shardNames []string) {
+    shards = &shardRings{
+        myShard:  myShard,
+        rings:    ring.NewRings(),
+        groups:   make(map[string]*groupcache.Group),
+        bindings: make(map[string]*peerbind.Binding),
+    }
+    http.Handle(ring.DefaultBasePath, peerHandler())
+
+    for _, shard := range shardNames {
+        groupName := "primeFactors-" + shard
+        pool := ring.NewPool(selfUrl, ringOptions(ring.Options{}))
+        shards.rings.Add(shard, pool)
+        shards.rings.Bind(groupName, shard)
+        withBreaker(shards.rings, shard)
+        withHotKeys(shards.rings, shard, hotKeyOptions("HOT_KEY"))
+        withZones(shards.rings, shard)
+        shards.groups[shard] = groupcache.NewGroup(groupName, 1 << 20, groupGetter())
+        shards.groups[shard].SetPeerFallback(PeerFallback)
+        shards.groups[shard].SetTTL(groupTTL())
+        rebalancers = append(rebalancers, ring.NewRebalancer(pool, []*groupcache.Group{shards.groups[shard]}, nil))
+
+        binding, err := peerbind.Bind(groupName, peerwatch.ShardSource(listOptions, shardLabel, shard), pool, myIp, getPodUrl)
+        if err != nil {
+            log.Printf("WARNING: error getting initial pods of shard %s: %v", shard, err)
+        }
+        shards.bindings[shard] = binding
+    }
+}
+
+func (s *shardRings) writeStats(w io.Writer) {
+    fmt.Fprintln(w, "Own shard: ", s.myShard)
+    for shard, binding := range s.bindings {
+        peers := binding.Peers()
+        fmt.Fprintf(w, "Shard %s pod set: [%d] %v\n", shard, len(peers), peers)
+        writePeerStats(w, s.rings.Pool(shard))
+    }
+}
+
+func (s *shardRings) allBindings() []*peerbind.Binding {
+    bindings := make([]*peerbind.Binding, 0, len(s.bindings))
+    for _, binding := range s.bindings {
+        bindings = append(bindings, binding)
+    }
+    return bindings
+}
+
+// groupForRequest picks the group of the shard named by the request's shard parameter, defaulting to the
+// current pod's own shard. When not running sharded, it is PrimeFactorsGroup, or PrimeFactorsHeavyGroup for heavy numbers.
+func groupForRequest(r *http.Request) (*groupcache.Group, bool) {
+    if shards == nil {
+        if PrimeFactorsHeavyGroup != nil && isHeavy(r.FormValue("n")) {
+            return PrimeFactorsHeavyGroup, true
+        }
+        return PrimeFactorsGroup, true
+    }
+    shard := r.FormValue("shard")
+    if shard == "" {
+        shard = shards.myShard
+    }
+    group, ok := shards.groups[shard]
+    return group, ok
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "os/signal"
+    "sync"
+    "sync/atomic"
+    "syscall"
+    "time"
+)
+
+// PreStopDelay is how long /prestop waits after marking the pod unready, so that peers and the service
+// stop routing to it before the process is signalled. It must exceed the time the readiness probe takes to notice
+// (periodSeconds * failureThreshold in the chart, 2s), plus the time for peers to hear of it.
+const PreStopDelay = 5 * time.Second
+
+// ShutdownTimeout bounds how long shutting down takes, from waiting for in-flight loads to closing the server. It
+// must stay below the pod's terminationGracePeriodSeconds.
+const ShutdownTimeout = 20 * time.Second
+
+// HandOffTimeout is the share of ShutdownTimeout kept for handing cached data off, however long in-flight loads
+// take.
+const HandOffTimeout = 5 * time.Second
+
+// lifecycle tracks whether the process is shutting down, and the loads still in flight.
+type lifecycle struct {
+    draining int32 // accessed atomically, 1 once shutting down
+
+    mu       sync.Mutex
+    inFlight int
+    idle     chan struct{} // closed once inFlight drops to 0, while waitInFlight waits for it
+}
+
+var life lifecycle
+
+// drain marks the process as shutting down: it reports unready, leaves the ring, and refuses new peer requests.
+func (l *lifecycle) drain() {
+    if atomic.CompareAndSwapInt32(&l.draining, 0, 1) {
+        log.Printf("Draining: marked unready, refusing new peer requests")
+        leaveRing()
+    }
+}
+
+func (l *lifecycle) isDraining() bool {
+    return atomic.LoadInt32(&l.draining) == 1
+}
+
+// track counts the requests handled by handler as in-flight loads.
+func (l *lifecycle) track(handler http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        l.begin()
+        defer l.end()
+        handler.ServeHTTP(w, r)
+    })
+}
+
+// begin counts a load as in flight. Loads may begin while waitInFlight waits, e.g. for requests which are still
+// served once draining: it waits for those too.
+func (l *lifecycle) begin() {
+    l.mu.Lock()
+    l.inFlight++
+    l.mu.Unlock()
+}
+
+func (l *lifecycle) end() {
+    l.mu.Lock()
+    l.inFlight--
+    if l.inFlight == 0 && l.idle != nil {
+        close(l.idle)
+        l.idle = nil
+    }
+    l.mu.Unlock()
+}
+
+// peerHandler wraps the groupcache peer handler: once draining, new peer requests are refused, so that peers
+// fall back to loading locally instead of waiting on a pod which is about to disappear.
+func (l *lifecycle) peerHandler(handler http.Handler) http.Handler {
+    tracked := l.track(handler)
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if l.isDraining() {
+            http.Error(w, "shutting down", http.StatusServiceUnavailable)
+            return
+        }
+        tracked.ServeHTTP(w, r)
+    })
+}
+
+// waitInFlight waits for in-flight loads to finish, or ctx to be done, whichever comes first.
+func (l *lifecycle) waitInFlight(ctx context.Context) error {
+    l.mu.Lock()
+    if l.inFlight == 0 {
+        l.mu.Unlock()
+        return nil
+    }
+    if l.idle == nil {
+        l.idle = make(chan struct{})
+    }
+    idle := l.idle
+    l.mu.Unlock()
+    select {
+    case <-idle:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+// Ready is the readiness probe: it fails once the pod is shutting down, so that peers drop it from their rings.
+func Ready(w http.ResponseWriter, _ *http.Request) {
+    if life.isDraining() {
+        http.Error(w, "shutting down", http.StatusServiceUnavailable)
+        return
+    }
+    fmt.Fprintf(w, "ok\n")
+}
+
+// PreStop is the preStop lifecycle hook: it starts draining, then holds off termination for PreStopDelay
+// while the unready state propagates.
+func PreStop(w http.ResponseWriter, _ *http.Request) {
+    life.drain()
+    time.Sleep(PreStopDelay)
+    fmt.Fprintf(w, "ok\n")
+}
+
+// serveUntilSignalled runs server until SIGTERM or SIGINT, then shuts it down gracefully: it drains, waits
+// for in-flight loads, hands cached data off with handOff, and closes the server once its remaining requests
+// are done, while stop stops anything else serving requests. All of that is bounded by ShutdownTimeout, of which
+// handOff gets HandOffTimeout for itself.
+func serveUntilSignalled(server *http.Server, handOff func(ctx context.Context), stop func(ctx context.Context)) {
+    go func() {
+        listenAndServe := server.ListenAndServe
+        if server.TLSConfig != nil {
+            listenAndServe = func() error { return server.ListenAndServeTLS("", "") }
+        }
+        if err := listenAndServe(); err != nil && err != http.ErrServerClosed {
+            log.Fatalf("error in ListenAndServe: %s", err)
+        }
+    }()
+
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+    sig := <-signals
+    log.Printf("Got %v, shutting down", sig)
+
+    life.drain()
+    ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+    defer cancel()
+    waitCtx, cancelWait := context.WithTimeout(ctx, ShutdownTimeout-HandOffTimeout)
+    if err := life.waitInFlight(waitCtx); err != nil {
+        log.Printf("WARNING: gave up waiting for in-flight loads: %v", err)
+    }
+    cancelWait()
+    handOffCtx, cancelHandOff := context.WithTimeout(ctx, HandOffTimeout)
+    handOff(handOffCtx)
+    cancelHandOff()
+    stopped := make(chan struct{})
+    go func() {
+        stop(ctx)
+        close(stopped)
+    }()
+    if err := server.Shutdown(ctx); err != nil {
+        log.Printf("WARNING: error shutting down http server: %v", err)
+    }
+    <-stopped
+    log.Printf("Shut down")
+}
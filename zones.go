@@ -0,0 +1,69 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "log"
+    "sort"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "github.com/robwil/peer-aware-groupcache/peerwatch"
+    "github.com/robwil/peer-aware-groupcache/ring"
+)
+
+// zoneAware is only set when peers know each other's zones.
+var zoneAware *peerZones
+
+// peerZones discovers the zones of the pods matching listOptions, for every ring to count cross-zone fetches and
+// optionally replicate hot keys within each zone.
+type peerZones struct {
+    listOptions metav1.ListOptions
+    opts        ring.ZoneOptions
+    pickers     map[string]*ring.Zones // keyed by ring name
+}
+
+// add has the groups of the named ring pick their peers through a ring.Zones, wrapping the ring's current picker.
+func (z *peerZones) add(rings *ring.Rings, ringName string) {
+    zones := ring.NewZones(rings.Pool(ringName), rings.Picker(ringName), &z.opts)
+    z.pickers[ringName] = zones
+    rings.SetPicker(ringName, zones)
+}
+
+// watch applies the zones of peers to every ring, and keeps doing so as they change.
+func (z *peerZones) watch() {
+    if err := peerwatch.WatchZones(z.listOptions, z.apply); err != nil {
+        // every fetch is in an unknown zone until the zones of peers can be listed
+        log.Printf("WARNING: error discovering peer zones: %v", err)
+    }
+}
+
+func (z *peerZones) apply(zones map[string]string) {
+    urls := make(map[string]string, len(zones))
+    for ip, zone := range zones {
+        urls[getPodUrl(ip)] = zone
+    }
+    for _, picker := range z.pickers {
+        picker.SetZones(urls)
+    }
+}
+
+func (z *peerZones) writeStats(w io.Writer) {
+    names := make([]string, 0, len(z.pickers))
+    for name := range z.pickers {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        zones := z.pickers[name]
+        fmt.Fprintf(w, "Zone of %s: %q, peers by zone: %v\n", name, zones.Zone(), zones.PeersByZone())
+        fmt.Fprintf(w, "Fetches for %s: %v in-zone (%v from zone-local owners), %v cross-zone, %v in unknown zones\n", name,
+            zones.Stats.InZone.String(), zones.Stats.ZoneLocal.String(), zones.Stats.CrossZone.String(), zones.Stats.UnknownZone.String())
+    }
+}
+
+// withZones wraps the picker of the named ring in a ring.Zones, when peers know each other's zones. It must be
+// called once the ring's other pickers are set.
+func withZones(rings *ring.Rings, ringName string) {
+    if zoneAware != nil {
+        zoneAware.add(rings, ringName)
+    }
+}